@@ -17,7 +17,7 @@ import (
 	"time"
 
 	"cheops.com/backends"
-	"cheops.com/env"
+	"cheops.com/config"
 	"cheops.com/model"
 	"cheops.com/replicator"
 	"github.com/gorilla/mux"
@@ -30,9 +30,32 @@ import (
 //
 //		Content-Disposition: form-data; name="command"
 //
-//			Mandatory: the command to run. If the command needs the
+//			Mandatory unless there is a template: the command to run. If the command needs the
 //			content of a local file, this file must be wrapped with {} and included as a file
-//			(see later)
+//			(see later). Only accepted if operations.permissive is true
+//
+//		Content-Disposition: form-data; name="template"
+//
+//			The name of a template of the configuration to run instead of
+//			a command
+//
+//		Content-Disposition: form-data; name="params"
+//
+//			Repeated, the parameters of the template, as name=value. A
+//			parameter of type file is the name of a file of the form
+//
+//		Content-Disposition: form-data; name="backend"
+//
+//			If present, the backend that runs the command: "shell" (the
+//			default) runs it with sh, "exec" runs the program named by the
+//			command with the "args" parts as arguments, "http" sends the
+//			"METHOD URL [{file}]" request of the command with the "args"
+//			parts as "Name: value" headers
+//
+//		Content-Disposition: form-data; name="args"
+//
+//			Repeated, the arguments of the command, for the backends that
+//			take some
 //
 //		Content-Disposition: form-data; name="sites"
 //
@@ -53,8 +76,68 @@ import (
 //		Content-Disposition: form-data; name="XXX"; filename="XXX"
 //
 //			If present, a file that is needed for the command to run
+//
+//		Content-Disposition: form-data; name="timeout"
+//
+//			If present, how long to wait for the replies of all sites, as
+//			a duration ("90s", "5m") or a number of seconds. Sites that
+//			didn't reply in time get a TIMEOUT reply. It can't be more
+//			than requests.maxtimeout; requests.timeout is used otherwise
+//
+//		Content-Disposition: form-data; name="commandtimeout"
+//
+//			If present, how long the command can run on each site
+//			before it is killed, with a TIMEOUT reply. The Timeout of
+//			the resource config is used otherwise
+//
+//		Content-Disposition: form-data; name="async"
+//
+//			If "true", the reply is a 202 with only {"RequestId": "..."}
+//			as soon as the operation is saved, instead of the replies of
+//			the sites. Use '/requests/{requestId}' to follow it
+//
+// A POST on '/show/{id}' runs the command on every site and returns the
+// outputs, and takes the same "timeout", "backend", "args", "template" and
+// "params" parts.
+//
+// A DELETE on '/exec/{id}' deletes the resource everywhere. The body is
+// optional; if it is a multipart/form-data with a "command" part, that command
+// is run on every location instead of the cleanup of the resource config.
+//
+// A POST on '/relocate/{id}' changes the locations of the resource to the
+// "sites" part of the form. Removed sites run the "command" part if there is
+// one, the cleanup of the resource config otherwise.
+//
+// Both also take the "timeout", "backend", "args", "template" and "params"
+// parts, like the POST on '/exec/{id}'.
+//
+// A GET on '/requests/{requestId}' returns every reply to the request that
+// this site knows of, and the sites that haven't replied yet.
+//
+// A POST on '/cancel/{requestId}' kills the command of the request if it is
+// running on this site. It gets a KO reply and is not attempted again.
+//
+// A GET on '/templates' returns the templates of this node, and whether it
+// also accepts raw commands.
+//
+// A GET on '/checkpoints' returns where each watcher of the changes feed is.
+// A DELETE on '/checkpoints/{name}' makes the watcher process the whole
+// database again; a DELETE on '/checkpoints' does it for all watchers.
+
+func Run(cfg config.Config, repl *replicator.Replicator) {
+	client, err := cfg.Client()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func Run(port int, repl *replicator.Replicator) {
+	err = cfg.ListenAndServe(config.ServiceAPI, newRouter(cfg, repl, client))
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// newRouter returns the routes of the API. client calls the other sites
+func newRouter(cfg config.Config, repl *replicator.Replicator, client *http.Client) http.Handler {
 	m := mux.NewRouter()
 	m.HandleFunc("/show/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id, command, _, _, sites, _, ok := parseRequest(w, r)
@@ -68,17 +151,36 @@ func Run(port int, repl *replicator.Replicator) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		if !authorize(w, r, cfg.Auth, config.ActionShow, id, sites) {
+			return
+		}
+		// The sites only get the certificate of this node, not the one
+		// of the caller
+		if cfg.Auth.Enabled && bearerToken(r) == "" {
+			log.Printf("Refused /show for %s, authenticated with a certificate\n", user(r))
+			http.Error(w, "callers with a certificate must use /show_local on each site", http.StatusForbidden)
+			return
+		}
+
+		// Each site checks the command too, this is to fail early
+		if _, ok := parseCommand(w, r, cfg.Operations, command, nil); !ok {
+			return
+		}
 
 		type SiteResp struct {
 			Status string // OK, KO or TIMEOUT
 			Output string
 		}
 
+		timeout, ok := parseTimeout(w, r, cfg.Requests)
+		if !ok {
+			return
+		}
+
 		// Site -> SiteResp
 		resp := make(map[string]SiteResp)
 
-		thirtySeconds, _ := time.ParseDuration("30s")
-		ctxWithTimeout, cancel := context.WithTimeout(r.Context(), thirtySeconds)
+		ctxWithTimeout, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 
 		g, ctx := errgroup.WithContext(ctxWithTimeout)
@@ -87,11 +189,15 @@ func Run(port int, repl *replicator.Replicator) {
 			site := site
 			g.Go(func() error {
 
-				u := fmt.Sprintf("http://%s:8079/show_local/%s", site, id)
+				u := fmt.Sprintf("%s://%s/show_local/%s", cfg.Scheme(), cfg.SiteAddress(site), id)
 
 				var b bytes.Buffer
 				mw := multipart.NewWriter(&b)
-				mw.WriteField("command", command)
+				for _, field := range commandFields {
+					for _, value := range r.MultipartForm.Value[field] {
+						mw.WriteField(field, value)
+					}
+				}
 				mw.Close()
 
 				req, err := http.NewRequestWithContext(ctx, "POST", u, &b)
@@ -105,7 +211,11 @@ func Run(port int, repl *replicator.Replicator) {
 				}
 				req.Header.Set("Content-Length", strconv.Itoa(b.Len()))
 				req.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", mw.Boundary()))
-				reply, err := http.DefaultClient.Do(req)
+				// Each site authorizes the caller too
+				if auth := r.Header.Get("Authorization"); auth != "" {
+					req.Header.Set("Authorization", auth)
+				}
+				reply, err := client.Do(req)
 				if err != nil || reply.StatusCode != http.StatusOK {
 					var reason string
 					if err != nil {
@@ -159,9 +269,16 @@ func Run(port int, repl *replicator.Replicator) {
 		if !ok {
 			return
 		}
+		if !authorize(w, r, cfg.Auth, config.ActionShow, id, []string{cfg.LocalSite.Name}) {
+			return
+		}
+		cmd, ok := parseCommand(w, r, cfg.Operations, command, nil)
+		if !ok {
+			return
+		}
 
-		command = strings.Replace(command, "__ID__", id, -1)
-		res, err := repl.RunDirect(r.Context(), command)
+		cmd.Command = strings.Replace(cmd.Command, "__ID__", id, -1)
+		res, err := repl.RunDirect(r.Context(), cmd)
 		status := "OK"
 		if err != nil {
 			log.Printf("Error running command: %v\n", err)
@@ -183,7 +300,222 @@ func Run(port int, repl *replicator.Replicator) {
 	})
 
 	m.HandleFunc("/exec/{id}", func(w http.ResponseWriter, r *http.Request) {
-		id, command, typ, config, sites, files, ok := parseExecRequest(w, r)
+		id, command, _, ok := parseOptionalForm(w, r)
+		if !ok {
+			return
+		}
+		current, ok := locations(w, r, repl, id)
+		if !ok {
+			return
+		}
+		if !authorize(w, r, cfg.Auth, config.ActionDelete, id, current) {
+			return
+		}
+		timeout, ok := parseTimeout(w, r, cfg.Requests)
+		if !ok {
+			return
+		}
+
+		requestId, err := newRequestId()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		cmd, ok := parseCommand(w, r, cfg.Operations, command, nil)
+		if !ok {
+			return
+		}
+		req := model.Operation{
+			Command:   cmd,
+			RequestId: requestId,
+			Time:      time.Now(),
+			Identity:  user(r),
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		replies, err := repl.Delete(ctx, id, req)
+		if err != nil {
+			if err == replicator.ErrDoesNotExist {
+				log.Printf("resource [%s] does not exist on this site\n", id)
+				http.NotFound(w, r)
+				return
+			}
+
+			if e, ok := err.(replicator.ErrInvalidRequest); ok {
+				log.Printf("invalid request for [%s]: %s\n", id, e)
+				http.Error(w, e.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Println(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		writeReplies(w, replies)
+	}).Methods("DELETE")
+
+	m.HandleFunc("/relocate/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, command, sites, ok := parseOptionalForm(w, r)
+		if !ok {
+			return
+		}
+		timeout, ok := parseTimeout(w, r, cfg.Requests)
+		if !ok {
+			return
+		}
+		if len(sites) == 0 {
+			log.Println("Missing sites")
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// The removed sites run the command too, the caller must be
+		// allowed on them as well as on the new ones
+		current, ok := locations(w, r, repl, id)
+		if !ok {
+			return
+		}
+		if !authorize(w, r, cfg.Auth, config.ActionRelocate, id, append(current, sites...)) {
+			return
+		}
+
+		requestId, err := newRequestId()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		cmd, ok := parseCommand(w, r, cfg.Operations, command, nil)
+		if !ok {
+			return
+		}
+		req := model.Operation{
+			Command:   cmd,
+			RequestId: requestId,
+			Time:      time.Now(),
+			Identity:  user(r),
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		replies, err := repl.Relocate(ctx, id, sites, req)
+		if err != nil {
+			if err == replicator.ErrDoesNotExist {
+				log.Printf("resource [%s] does not exist on this site\n", id)
+				http.NotFound(w, r)
+				return
+			}
+
+			if e, ok := err.(replicator.ErrInvalidRequest); ok {
+				log.Printf("invalid request for [%s]: %s\n", id, e)
+				http.Error(w, e.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Println(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		writeReplies(w, replies)
+	}).Methods("POST")
+
+	m.HandleFunc("/requests/{requestId}", func(w http.ResponseWriter, r *http.Request) {
+		requestId := mux.Vars(r)["requestId"]
+		status, err := repl.RequestStatus(r.Context(), requestId)
+		if err == replicator.ErrDoesNotExist {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		// A relocation that removes no site has no pending sites, the
+		// locations of the resource are there too
+		sites, ok := locations(w, r, repl, status.ResourceId)
+		if !ok {
+			return
+		}
+		sites = append(sites, status.Pending...)
+		for _, reply := range status.Replies {
+			sites = append(sites, reply.Site)
+		}
+		if !authorize(w, r, cfg.Auth, config.ActionShow, status.ResourceId, sites) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}).Methods("GET")
+
+	m.HandleFunc("/cancel/{requestId}", func(w http.ResponseWriter, r *http.Request) {
+		requestId := mux.Vars(r)["requestId"]
+		if cfg.Auth.Enabled {
+			status, err := repl.RequestStatus(r.Context(), requestId)
+			if err == replicator.ErrDoesNotExist {
+				http.Error(w, "no command of this request is running here", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if !authorize(w, r, cfg.Auth, config.ActionCancel, status.ResourceId, []string{cfg.LocalSite.Name}) {
+				return
+			}
+		}
+		err := repl.Cancel(requestId)
+		if err == replicator.ErrDoesNotExist {
+			http.Error(w, "no command of this request is running here", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+
+	m.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		// For those who can run commands on some resources
+		if cfg.Auth.Enabled && !cfg.Auth.AllowsSomewhere(user(r), config.ActionExec) {
+			log.Printf("Refused templates for %s\n", user(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.Operations)
+	}).Methods("GET")
+
+	m.HandleFunc("/checkpoints", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, cfg.Auth, config.ActionAdmin, "", nil) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(repl.Checkpoints())
+	}).Methods("GET")
+
+	resetCheckpoint := func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, cfg.Auth, config.ActionAdmin, "", nil) {
+			return
+		}
+		name := mux.Vars(r)["name"]
+		err := repl.ResetCheckpoint(r.Context(), name)
+		if err == replicator.ErrDoesNotExist {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Couldn't reset checkpoint [%s]: %v\n", name, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(repl.Checkpoints())
+	}
+	m.HandleFunc("/checkpoints", resetCheckpoint).Methods("DELETE")
+	m.HandleFunc("/checkpoints/{name}", resetCheckpoint).Methods("DELETE")
+
+	m.HandleFunc("/exec/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, command, typ, resourceConfig, sites, files, ok := parseExecRequest(w, r)
 		if !ok {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
@@ -197,7 +529,7 @@ func Run(port int, repl *replicator.Replicator) {
 
 		forMe := false
 		for _, desiredSite := range sites {
-			if desiredSite == env.Myfqdn {
+			if desiredSite == cfg.LocalSite.Name {
 				forMe = true
 			}
 		}
@@ -205,25 +537,84 @@ func Run(port int, repl *replicator.Replicator) {
 			http.Error(w, "Site is not in locations", http.StatusBadRequest)
 			return
 		}
+		// The sites of the form only matter for a new resource, an
+		// existing one runs on its locations
+		current, ok := locations(w, r, repl, id)
+		if !ok {
+			return
+		}
+		if current == nil {
+			current = sites
+		}
+		if !authorize(w, r, cfg.Auth, config.ActionExec, id, current) {
+			return
+		}
+
+		timeout, ok := parseTimeout(w, r, cfg.Requests)
+		if !ok {
+			return
+		}
 
-		randBytes, err := io.ReadAll(&io.LimitedReader{R: rand.Reader, N: 64})
+		commandTimeout, ok := parseDuration(w, r, "commandtimeout")
+		if !ok {
+			return
+		}
+
+		var async bool
+		if values := r.MultipartForm.Value["async"]; len(values) > 0 {
+			var err error
+			async, err = strconv.ParseBool(strings.TrimSpace(values[0]))
+			if err != nil {
+				log.Printf("Invalid async: %v\n", err)
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		requestId, err := newRequestId()
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
 
-		cmd := backends.ShellCommand{
-			Command: command,
-			Files:   files,
+		cmd, ok := parseCommand(w, r, cfg.Operations, command, files)
+		if !ok {
+			return
+		}
+		if resourceConfig.Cleanup != "" && !cfg.Operations.Permissive {
+			log.Println("Refused raw cleanup")
+			http.Error(w, "this node only runs templates, the config can only have a CleanupTemplate", http.StatusForbidden)
+			return
+		}
+		if name := resourceConfig.CleanupTemplate; name != "" {
+			t, ok := cfg.Operations.Template(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown cleanup template %s", name), http.StatusBadRequest)
+				return
+			}
+			if _, err := backends.Expand(t, resourceConfig.CleanupParams, nil); err != nil {
+				log.Printf("Invalid parameters for cleanup template %s: %v\n", name, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 		req := model.Operation{
 			Command:   cmd,
 			Type:      typ,
-			RequestId: base32.StdEncoding.EncodeToString(randBytes),
+			RequestId: requestId,
 			Time:      time.Now(),
+			Timeout:   model.Duration(commandTimeout),
+			Identity:  user(r),
 		}
 
-		replies, err := repl.Do(r.Context(), sites, id, req, config)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if async {
+			// Nobody waits for the replies, they must not be canceled
+			// with the request
+			ctx = context.Background()
+		}
+		replies, err := repl.Do(ctx, sites, id, req, resourceConfig)
 		if err != nil {
 			if err == replicator.ErrDoesNotExist {
 				log.Printf("resource [%s] does not exist on this site\n", id)
@@ -242,20 +633,188 @@ func Run(port int, repl *replicator.Replicator) {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		for reply := range replies {
-			json.NewEncoder(w).Encode(reply)
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
+		if async {
+			go func() {
+				for range replies {
+				}
+			}()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(struct{ RequestId string }{requestId})
+			return
 		}
 
+		writeReplies(w, replies)
 	})
 
-	err := http.ListenAndServe(":"+strconv.Itoa(port), m)
-	if err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	m.Use(authenticate(cfg.Auth))
+	return m
+}
+
+func newRequestId() (string, error) {
+	randBytes, err := io.ReadAll(&io.LimitedReader{R: rand.Reader, N: 64})
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(randBytes), nil
+}
+
+// writeReplies streams the replies as they arrive, one json object per line
+func writeReplies(w http.ResponseWriter, replies chan model.ReplyDocument) {
+	w.Header().Set("Content-Type", "application/json")
+	for reply := range replies {
+		json.NewEncoder(w).Encode(reply)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// parseOptionalForm parses requests where the body is optional: it may be a
+// multipart/form-data with a command and sites
+func parseOptionalForm(w http.ResponseWriter, r *http.Request) (id, command string, sites []string, ok bool) {
+	id = mux.Vars(r)["id"]
+	if uid, err := url.PathUnescape(id); err != nil || uid != id {
+		log.Println("Unsafe id")
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err := r.ParseMultipartForm(1024 * 1024)
+	if err == http.ErrNotMultipart {
+		ok = true
+		return
+	}
+	if err != nil {
+		log.Printf("Error parsing multipart form: %v\n", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if commands, okk := r.MultipartForm.Value["command"]; okk && len(commands) == 1 {
+		command = strings.TrimSpace(commands[0])
+	}
+	for _, group := range r.MultipartForm.Value["sites"] {
+		for _, val := range strings.Split(group, "&") {
+			if site := strings.TrimSpace(val); site != "" {
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	ok = true
+	return
+}
+
+// commandFields are the parts of forms that make the command
+var commandFields = []string{"command", "backend", "args", "template", "params"}
+
+// parseCommand returns the command of the already parsed form. It is either
+// the "template" part expanded with the "params" parts, or the command run by
+// the backend of the "backend" part with the "args" parts as arguments, which
+// is only accepted if the node is permissive
+func parseCommand(w http.ResponseWriter, r *http.Request, ops config.Operations, command string, files map[string][]byte) (cmd backends.Command, ok bool) {
+	cmd = backends.Command{
+		Command: command,
+		Files:   files,
+	}
+	if r.MultipartForm == nil {
+		ok = true
+		return
+	}
+
+	if values := r.MultipartForm.Value["template"]; len(values) > 0 {
+		name := strings.TrimSpace(values[0])
+		if command != "" {
+			http.Error(w, "a request can't have both a command and a template", http.StatusBadRequest)
+			return
+		}
+		t, okk := ops.Template(name)
+		if !okk {
+			log.Printf("Unknown template %s\n", name)
+			http.Error(w, fmt.Sprintf("unknown template %s", name), http.StatusBadRequest)
+			return
+		}
+		params := make(map[string]string)
+		for _, param := range r.MultipartForm.Value["params"] {
+			parts := strings.SplitN(param, "=", 2)
+			if len(parts) != 2 {
+				http.Error(w, fmt.Sprintf("invalid parameter %q, expected name=value", param), http.StatusBadRequest)
+				return
+			}
+			params[strings.TrimSpace(parts[0])] = parts[1]
+		}
+		cmd, err := backends.Expand(t, params, files)
+		if err != nil {
+			log.Printf("Invalid parameters for template %s: %v\n", name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return cmd, false
+		}
+		return cmd, true
 	}
+
+	if command != "" && !ops.Permissive {
+		log.Println("Refused raw command")
+		http.Error(w, "this node only runs templates", http.StatusForbidden)
+		return
+	}
+	if values := r.MultipartForm.Value["backend"]; len(values) > 0 {
+		cmd.Backend = strings.TrimSpace(values[0])
+	}
+	if _, okk := backends.Lookup(cmd.BackendName()); !okk {
+		log.Printf("Unknown backend %s\n", cmd.Backend)
+		http.Error(w, fmt.Sprintf("unknown backend %s, expected one of %s", cmd.Backend, strings.Join(backends.Names(), ", ")), http.StatusBadRequest)
+		return
+	}
+	cmd.Args = r.MultipartForm.Value["args"]
+
+	ok = true
+	return
+}
+
+// parseTimeout returns the timeout asked for in the already parsed form, or
+// the default one
+func parseTimeout(w http.ResponseWriter, r *http.Request, cfg config.Requests) (timeout time.Duration, ok bool) {
+	timeout, ok = parseDuration(w, r, "timeout")
+	if !ok {
+		return
+	}
+	if timeout == 0 {
+		return cfg.Timeout, true
+	}
+	if timeout > cfg.MaxTimeout {
+		http.Error(w, fmt.Sprintf("timeout is more than the maximum of %v", cfg.MaxTimeout), http.StatusBadRequest)
+		return 0, false
+	}
+	return
+}
+
+// parseDuration returns the duration in the given field of the already
+// parsed form, as a duration or a number of seconds, or 0 if there is none
+func parseDuration(w http.ResponseWriter, r *http.Request, field string) (d time.Duration, ok bool) {
+	if r.MultipartForm == nil || len(r.MultipartForm.Value[field]) == 0 {
+		return 0, true
+	}
+
+	value := strings.TrimSpace(r.MultipartForm.Value[field][0])
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, errr := strconv.Atoi(value)
+		if errr != nil {
+			log.Printf("Invalid %s: %v\n", field, err)
+			http.Error(w, "invalid "+field, http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		log.Printf("Invalid %s: %v\n", field, d)
+		http.Error(w, "invalid "+field, http.StatusBadRequest)
+		return
+	}
+
+	ok = true
+	return
 }
 
 func parseExecRequest(w http.ResponseWriter, r *http.Request) (id, command string, typ model.OperationType, config model.ResourceConfig, sites []string, files map[string][]byte, ok bool) {
@@ -304,13 +863,15 @@ func parseRequest(w http.ResponseWriter, r *http.Request) (id, command string, t
 		}
 	}
 
-	commands, okk := r.MultipartForm.Value["command"]
-	if !okk || len(commands) != 1 {
+	commands := r.MultipartForm.Value["command"]
+	switch {
+	case len(commands) == 1:
+		command = strings.TrimSpace(commands[0])
+	case len(commands) > 1 || len(r.MultipartForm.Value["template"]) == 0:
 		log.Println("Missing command")
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	command = strings.TrimSpace(commands[0])
 
 	types, okk := r.MultipartForm.Value["type"]
 	if okk && len(types) == 1 {
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"cheops.com/config"
+	"cheops.com/replicator"
+)
+
+type userKey struct{}
+
+// authenticate makes the handlers know who the caller is. The caller is the
+// user with the token of the "Authorization: Bearer <token>" header, or the
+// user named by the common name of its verified client certificate. When
+// authentication is enabled, callers that are neither get a 401
+func authenticate(auth config.Auth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !auth.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			name, ok := "", false
+			if token := bearerToken(r); token != "" {
+				name, ok = auth.User(token)
+			} else if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				name = r.TLS.VerifiedChains[0][0].Subject.CommonName
+				for _, u := range auth.Users {
+					ok = ok || u.Name == name
+				}
+			}
+			if !ok {
+				log.Printf("Unauthenticated request to %s\n", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cheops"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, name)))
+		})
+	}
+}
+
+// bearerToken returns the token of the Authorization header, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[len("Bearer "):])
+}
+
+// user returns the name of the caller, or "" if authentication is disabled
+func user(r *http.Request) string {
+	name, _ := r.Context().Value(userKey{}).(string)
+	return name
+}
+
+// authorize returns true if the caller can do the action on the resource at
+// the given sites, and sends a 403 otherwise. sites is nil if they are not
+// known
+func authorize(w http.ResponseWriter, r *http.Request, auth config.Auth, action, resourceId string, sites []string) bool {
+	if allowed(r, auth, action, resourceId, sites) {
+		return true
+	}
+	log.Printf("Refused %s on [%s] for %s\n", action, resourceId, user(r))
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
+}
+
+// allowed returns true if the caller can do the action on the resource at
+// the given sites, for the handlers that leave out what the caller can't see
+// instead of refusing
+func allowed(r *http.Request, auth config.Auth, action, resourceId string, sites []string) bool {
+	return !auth.Enabled || auth.Allows(user(r), action, resourceId, sites)
+}
+
+// locations returns the sites where the resource is, the ones the action will
+// run on, or nil if the resource doesn't exist yet. It sends a 500 and returns
+// false if they can't be known
+func locations(w http.ResponseWriter, r *http.Request, repl *replicator.Replicator, id string) ([]string, bool) {
+	sites, err := repl.Locations(r.Context(), id)
+	if err == replicator.ErrDoesNotExist {
+		return nil, true
+	}
+	if err != nil {
+		log.Printf("Couldn't get the locations of [%s]: %v\n", id, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return sites, true
+}
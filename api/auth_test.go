@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cheops.com/config"
+	"cheops.com/replicator"
+)
+
+var testAuth = config.Auth{
+	Enabled: true,
+	Users: []config.User{
+		{Name: "alice", Token: "alice-token"},
+		{Name: "bob", Token: "bob-token"},
+		{Name: "carol"},
+		{Name: "dave", Token: "dave-token"},
+	},
+	Rules: []config.Rule{
+		{Prefix: "front-", Users: []string{"alice", "carol"}, Actions: []string{"exec", "show", "delete", "relocate"}, Sites: []string{"s1", "s2"}},
+		{Prefix: "front-", Users: []string{"bob"}, Actions: []string{"exec", "show", "delete", "relocate"}, Sites: []string{"s1"}},
+		{Prefix: "front-", Users: []string{"dave"}, Actions: []string{"show"}, Sites: []string{"s2"}},
+	},
+}
+
+// newTestRouter returns the API of site s1, with a replicator on a store of
+// its own
+func newTestRouter(t *testing.T, auth config.Auth) http.Handler {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg := config.Default()
+	cfg.LocalSite.Name = "s1"
+	cfg.Auth = auth
+	repl := replicator.NewReplicatorWithStore(ctx, "s1", replicator.NewMemoryNetwork().Store("s1"), 1)
+	return newRouter(cfg, repl, http.DefaultClient)
+}
+
+// request returns a request with the fields as a multipart/form-data, and the
+// token if not empty
+func request(method, path, token string, fields map[string]string) *http.Request {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(method, path, &b)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// withCertificate makes the request come with a verified client certificate
+// for the name
+func withCertificate(r *http.Request, name string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := newTestRouter(t, testAuth)
+
+	show := map[string]string{"command": "true"}
+	w := serve(h, request("POST", "/show_local/front-app", "", show))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected a 401 without credentials, got %d", w.Code)
+	}
+	if w := serve(h, request("POST", "/show_local/front-app", "unknown", show)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 with an unknown token, got %d", w.Code)
+	}
+	if w := serve(h, withCertificate(request("POST", "/show_local/front-app", "", show), "mallory")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 with the certificate of an unknown user, got %d", w.Code)
+	}
+	if w := serve(h, request("POST", "/show_local/front-app", "bob-token", show)); w.Code != http.StatusOK {
+		t.Fatalf("Expected bob to be allowed, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(h, withCertificate(request("POST", "/show_local/front-app", "", show), "carol")); w.Code != http.StatusOK {
+		t.Fatalf("Expected carol to be allowed with a certificate, got %d: %s", w.Code, w.Body)
+	}
+
+	h = newTestRouter(t, config.Auth{})
+	if w := serve(h, request("POST", "/show_local/front-app", "", show)); w.Code != http.StatusOK {
+		t.Fatalf("Expected everyone to be allowed without authentication, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	h := newTestRouter(t, testAuth)
+
+	// The resource is on both sites
+	create := map[string]string{"command": "true", "type": "apply", "sites": "s1&s2", "async": "true"}
+	if w := serve(h, request("POST", "/exec/front-app", "bob-token", create)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to create a resource on s2, got %d", w.Code)
+	}
+	w := serve(h, request("POST", "/exec/front-app", "alice-token", create))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected alice to create the resource, got %d: %s", w.Code, w.Body)
+	}
+	var created struct{ RequestId string }
+	json.NewDecoder(w.Body).Decode(&created)
+	if w := serve(h, request("GET", "/requests/"+created.RequestId, "bob-token", nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to follow a request on s2, got %d", w.Code)
+	}
+	if w := serve(h, request("GET", "/requests/"+created.RequestId, "alice-token", nil)); w.Code != http.StatusOK {
+		t.Fatalf("Expected alice to follow the request, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(h, request("POST", "/exec/back-app", "alice-token", create)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected alice not to create a resource with another prefix, got %d", w.Code)
+	}
+
+	// An existing resource runs on its locations, whatever the sites of
+	// the request
+	exec := map[string]string{"command": "true", "type": "apply", "sites": "s1", "async": "true"}
+	if w := serve(h, request("POST", "/exec/front-app", "bob-token", exec)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to run commands on s2, got %d", w.Code)
+	}
+
+	// s2 is removed, and runs the command too
+	relocate := map[string]string{"sites": "s1"}
+	if w := serve(h, request("POST", "/relocate/front-app", "bob-token", relocate)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to relocate away from s2, got %d", w.Code)
+	}
+
+	show := map[string]string{"command": "true"}
+	if w := serve(h, request("POST", "/show_local/front-app", "dave-token", show)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected dave not to show on s1, got %d", w.Code)
+	}
+
+	if w := serve(h, request("GET", "/templates", "dave-token", nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected dave not to get the templates, got %d", w.Code)
+	}
+	if w := serve(h, request("GET", "/templates", "bob-token", nil)); w.Code != http.StatusOK {
+		t.Fatalf("Expected bob to get the templates, got %d", w.Code)
+	}
+
+	// /show_local on the other sites wouldn't get carol's certificate
+	show["sites"] = "s1"
+	w = serve(h, withCertificate(request("POST", "/show/front-app", "", show), "carol"))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "/show_local") {
+		t.Fatalf("Expected carol to be told to use /show_local, got %d: %s", w.Code, w.Body)
+	}
+
+	del := map[string]string{"timeout": "100ms"}
+	if w := serve(h, request("DELETE", "/exec/front-app", "bob-token", del)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected bob not to delete on s2, got %d", w.Code)
+	}
+	if w := serve(h, request("DELETE", "/exec/front-app", "alice-token", del)); w.Code != http.StatusOK {
+		t.Fatalf("Expected alice to delete the resource, got %d: %s", w.Code, w.Body)
+	}
+}
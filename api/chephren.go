@@ -1,21 +1,30 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 
-	"cheops.com/env"
+	"cheops.com/config"
 	"cheops.com/replicator"
 	"github.com/gorilla/mux"
 )
 
-func RunChephren(port int, repl *replicator.Replicator) {
+const (
+	// How many events can wait for a slow client before it is disconnected
+	eventsQueueSize = 256
+
+	// How often a comment is sent on idle event streams so that proxies
+	// don't close them
+	eventsKeepalive = 30 * time.Second
+)
+
+func RunChephren(cfg config.Config, repl *replicator.Replicator) {
 
 	router := mux.NewRouter().SkipClean(true)
 	corsMiddleware := func(next http.Handler) http.Handler {
@@ -31,6 +40,7 @@ func RunChephren(port int, repl *replicator.Replicator) {
 	router.Use(corsMiddleware)
 
 	apiRouter := router.PathPrefix("//api").Subrouter()
+	apiRouter.Use(authenticate(cfg.Auth))
 	apiRouter.HandleFunc("/node", func(w http.ResponseWriter, r *http.Request) {
 		count, err := repl.CountResources()
 		if err != nil {
@@ -47,8 +57,8 @@ func RunChephren(port int, repl *replicator.Replicator) {
 		}
 
 		resp := nodeReply{
-			Name:           env.Myfqdn,
-			Address:        fmt.Sprintf("http://%s:%d", env.Myfqdn, port),
+			Name:           cfg.LocalSite.Name,
+			Address:        fmt.Sprintf("%s://%s:%d", cfg.Scheme(), cfg.LocalSite.Name, cfg.Service(config.ServiceChephren).Port),
 			State:          "ONLINE",
 			ResourcesCount: count,
 		}
@@ -73,6 +83,10 @@ func RunChephren(port int, repl *replicator.Replicator) {
 
 		resp := make([]resourceSummaryReply, 0)
 		for resourceId, replies := range replies {
+			// The replies are the ones of this site
+			if !allowed(r, cfg.Auth, config.ActionShow, resourceId, []string{cfg.LocalSite.Name}) {
+				continue
+			}
 			rr := resourceSummaryReply{
 				Id:            resourceId,
 				Name:          resourceId,
@@ -87,6 +101,9 @@ func RunChephren(port int, repl *replicator.Replicator) {
 	apiRouter.HandleFunc("/resource/{id}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
+		if !authorize(w, r, cfg.Auth, config.ActionShow, id, []string{cfg.LocalSite.Name}) {
+			return
+		}
 		repliesMap, err := repl.GetOrderedReplies(id)
 		if err != nil {
 			log.Printf("Error with getResources: %v\n", err)
@@ -123,8 +140,93 @@ func RunChephren(port int, repl *replicator.Replicator) {
 		json.NewEncoder(w).Encode(resp)
 	}).Methods("GET")
 
-	err := http.ListenAndServe(":"+strconv.Itoa(port), router)
+	apiRouter.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, cfg.Auth, config.ActionAdmin, "", nil) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(repl.Metrics())
+	}).Methods("GET")
+
+	// Server-Sent Events of what happens to the resources, optionally only
+	// those of the resource and site given in the query. Callers only get
+	// the events of the resources they can show, and the replication events
+	// if they are admins
+	apiRouter.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		resourceId := r.URL.Query().Get("resource")
+		site := r.URL.Query().Get("site")
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		events := make(chan replicator.Event, eventsQueueSize)
+		repl.WatchEvents(ctx, func(e replicator.Event) {
+			if !e.Concerns(resourceId, site) || !allowed(r, cfg.Auth, eventAction(e), e.ResourceId, eventSites(e)) {
+				return
+			}
+			select {
+			case events <- e:
+			default:
+				// The client doesn't keep up, it has to reconnect and
+				// catch up with the other endpoints
+				log.Printf("Events client %s is too slow, closing\n", r.RemoteAddr)
+				cancel()
+			}
+		})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case e := <-events:
+				j, err := json.Marshal(e)
+				if err != nil {
+					log.Printf("Couldn't encode event: %v\n", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, j)
+			}
+			flusher.Flush()
+		}
+	}).Methods("GET")
+
+	err := cfg.ListenAndServe(config.ServiceChephren, router)
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
+
+// eventAction returns the action the caller must be allowed to do to get the
+// event
+func eventAction(e replicator.Event) string {
+	if e.ResourceId == "" {
+		return config.ActionAdmin
+	}
+	return config.ActionShow
+}
+
+// eventSites returns the sites the event is about: those of the reply, or the
+// locations of the resource
+func eventSites(e replicator.Event) []string {
+	switch {
+	case e.ResourceId == "":
+		return nil
+	case e.Type == replicator.EventReply:
+		return []string{e.Site}
+	default:
+		return e.Locations
+	}
+}
@@ -0,0 +1,222 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the backends that are always there
+const (
+	// Command is a script run by sh
+	Shell = "shell"
+
+	// Command is the program to run and Args its arguments, without a
+	// shell in between
+	Exec = "exec"
+
+	// Command is "METHOD URL", optionally followed by the {file} to send as
+	// the body, and Args are headers, as "Name: value"
+	HTTP = "http"
+
+	// Command is "apply", "patch" or "delete" followed by the {files} of
+	// the manifests, and Args are options, as "name=value". Only there if
+	// the node can reach a cluster
+	Kubernetes = "kubernetes"
+)
+
+// A Backend runs commands
+type Backend interface {
+	// Run runs the command and returns what it gave. Each output is cut to
+	// limit bytes, unless limit is 0. The error is an *ExitError if the
+	// command ran and failed. When ctx is done, the command is stopped
+	Run(ctx context.Context, cmd Command, limit int) (Result, error)
+}
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[string]Backend)
+)
+
+// Register makes a backend available under the name. Registering a name
+// twice replaces the first backend
+func Register(name string, b Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = b
+}
+
+// Lookup returns the backend registered under the name
+func Lookup(name string) (Backend, bool) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	b, ok := backends[name]
+	return b, ok
+}
+
+// Names returns the names of the registered backends, sorted
+func Names() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Command is what a backend runs, with the files it needs. In Command and
+// Args, any {file} is replaced with the file of that name
+type Command struct {
+	// The name of the backend that runs the command, Shell if empty
+	Backend string `json:",omitempty"`
+
+	// What to run, as the backend understands it
+	Command string
+
+	// Arguments for the backends that take some
+	Args []string `json:",omitempty"`
+
+	Files map[string][]byte
+
+	// The template the command was made from, with its parameters. Sites
+	// make the command again from their own template before running it
+	Template string            `json:",omitempty"`
+	Params   map[string]string `json:",omitempty"`
+}
+
+// IsEmpty returns true if there is nothing to run
+func (c Command) IsEmpty() bool {
+	return c.Command == "" && c.Template == ""
+}
+
+// BackendName returns the name of the backend that runs the command
+func (c Command) BackendName() string {
+	if c.Backend == "" {
+		return Shell
+	}
+	return c.Backend
+}
+
+// ExitError is returned when a command ran but exited with a non-zero code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "failed"
+}
+
+// ExitCode returns the exit code of the command that returned err, or 0 if
+// it didn't run until the end
+func ExitCode(err error) int {
+	if e, ok := err.(*ExitError); ok {
+		return e.Code
+	}
+	return 0
+}
+
+// Classes of errors, for programs that need to know why a command failed
+const (
+	// The command, or the shell, doesn't exist
+	ErrorNotFound = "not-found"
+
+	// The command was killed by a signal
+	ErrorKilled = "killed"
+
+	// The command was stopped because it took too long
+	ErrorTimeout = "timeout"
+
+	// The command was stopped on request
+	ErrorCanceled = "canceled"
+
+	// The command exited with a non-zero code
+	ErrorExit = "non-zero-exit"
+
+	// The command couldn't be prepared or started
+	ErrorInternal = "internal"
+
+	// The site doesn't run this command: it isn't permissive and the
+	// command doesn't come from one of its templates
+	ErrorRefused = "refused"
+
+	// The command wasn't run because an operation before it failed
+	ErrorSkipped = "skipped"
+)
+
+// Result is what running a command gave
+type Result struct {
+	// stdout and stderr together, in the order they were read; writes to
+	// both that are close in time may not be in the order they were made
+	Output string
+	Stdout string
+	Stderr string
+
+	// true if an output was cut because it was longer than the limit
+	Truncated bool
+
+	ExitCode int
+	Duration time.Duration
+
+	// One of the Error* classes, or empty if the command succeeded
+	ErrorClass string
+
+	// The objects touched by the command, for backends that manage some
+	Objects []Object
+}
+
+// Object is an object of a cluster touched by a command
+type Object struct {
+	APIVersion string
+	Kind       string
+	Namespace  string `json:",omitempty"`
+	Name       string
+
+	// What was done: created, configured, unchanged, patched, deleted or
+	// not-found
+	Action string
+
+	// For workloads, how far their rollout is
+	Rollout string `json:",omitempty"`
+}
+
+// Run runs the command with its backend and returns what it gave. Each
+// output is cut to limit bytes, unless limit is 0. The error is an
+// *ExitError if the command ran and failed. When ctx is done, the command is
+// stopped
+func Run(ctx context.Context, cmd Command, limit int) (Result, error) {
+	b, ok := Lookup(cmd.BackendName())
+	if !ok {
+		log.Printf("Unknown backend %s\n", cmd.BackendName())
+		return Result{ErrorClass: ErrorNotFound}, fmt.Errorf("unknown backend %s", cmd.BackendName())
+	}
+
+	start := time.Now()
+	res, err := b.Run(ctx, cmd, limit)
+	res.Duration = time.Since(start)
+	return res, err
+}
+
+func Handle(ctx context.Context, commands []Command) (replies []string, err error) {
+	replies = make([]string, 0)
+	doRun := true
+
+	for i, cmd := range commands {
+		var output string
+		if doRun {
+			res, err2 := Run(ctx, cmd, 0)
+			if err2 != nil {
+				err = err2
+				doRun = false
+				log.Printf("Error running command %d, skipping %d\n", i+1, len(commands)-i-1)
+			}
+			output = res.Output
+		}
+		replies = append(replies, output)
+	}
+	return replies, err
+}
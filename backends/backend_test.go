@@ -0,0 +1,87 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunExec(t *testing.T) {
+	cmd := Command{
+		Backend: Exec,
+		Command: "cat",
+		Args:    []string{"{a file}"},
+		Files:   map[string][]byte{"a file": []byte("no $quoting; needed")},
+	}
+	res, err := Run(context.Background(), cmd, 0)
+	if err != nil {
+		t.Fatalf("Couldn't run: %v (%v)", err, res)
+	}
+	if res.Stdout != "no $quoting; needed" {
+		t.Fatalf("Expected the file, got %q", res.Stdout)
+	}
+
+	res, err = Run(context.Background(), Command{Backend: Exec, Command: "false"}, 0)
+	if ExitCode(err) != 1 || res.ErrorClass != ErrorExit {
+		t.Fatalf("Expected exit code 1, got %v (%v)", err, res.ErrorClass)
+	}
+
+	res, _ = Run(context.Background(), Command{Backend: Exec, Command: "this-command-does-not-exist"}, 0)
+	if res.ErrorClass != ErrorNotFound {
+		t.Fatalf("Expected class %s, got %s", ErrorNotFound, res.ErrorClass)
+	}
+}
+
+func TestRunHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable" {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.Header.Get("X-Test")+" "+string(body))
+	}))
+	defer server.Close()
+
+	cmd := Command{
+		Backend: HTTP,
+		Command: "put " + server.URL + "/counter {body.json}",
+		Args:    []string{"X-Test: yes"},
+		Files:   map[string][]byte{"body.json": []byte(`{"value": 1}`)},
+	}
+	res, err := Run(context.Background(), cmd, 0)
+	if err != nil {
+		t.Fatalf("Couldn't run: %v (%v)", err, res)
+	}
+	if res.Output != `PUT yes {"value": 1}` {
+		t.Fatalf("Unexpected output %q", res.Output)
+	}
+
+	res, err = Run(context.Background(), Command{Backend: HTTP, Command: "GET " + server.URL + "/unavailable"}, 0)
+	if ExitCode(err) != http.StatusServiceUnavailable || res.ErrorClass != ErrorExit {
+		t.Fatalf("Expected exit code 503, got %v (%v)", err, res.ErrorClass)
+	}
+	if res.Output != "try later\n" {
+		t.Fatalf("Unexpected output %q", res.Output)
+	}
+
+	res, err = Run(context.Background(), Command{Backend: HTTP, Command: "GET"}, 0)
+	if err == nil || res.ErrorClass != ErrorInternal {
+		t.Fatalf("Expected an invalid command, got %v (%v)", err, res.ErrorClass)
+	}
+}
+
+func TestRunUnknownBackend(t *testing.T) {
+	res, err := Run(context.Background(), Command{Backend: "unknown", Command: "true"}, 0)
+	if err == nil || res.ErrorClass != ErrorNotFound {
+		t.Fatalf("Expected an unknown backend, got %v (%v)", err, res.ErrorClass)
+	}
+
+	for _, name := range []string{Shell, Exec, HTTP} {
+		if _, ok := Lookup(name); !ok {
+			t.Fatalf("Expected backend %s, got %v", name, Names())
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package backends
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	Register(Exec, execBackend{})
+}
+
+// execBackend runs a program with its arguments, without a shell: nothing
+// in the arguments needs quoting
+type execBackend struct{}
+
+func (execBackend) Run(ctx context.Context, cmd Command, limit int) (Result, error) {
+	if cmd.Command == "" {
+		log.Printf("No program to run\n")
+		return internalError()
+	}
+
+	dir, replace, err := workingDir(cmd)
+	if err != nil {
+		return internalError()
+	}
+	defer os.RemoveAll(dir)
+
+	args := make([]string, 0, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		args = append(args, replace(arg))
+	}
+	program := replace(cmd.Command)
+
+	execCommand := exec.Command(program, args...)
+	execCommand.Dir = dir
+	return runProcess(ctx, execCommand, strings.Join(append([]string{program}, args...), " "), limit)
+}
@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	Register(HTTP, httpBackend{client: http.DefaultClient})
+}
+
+// httpBackend sends a request. The body of the response is the output, and a
+// status code that isn't 2xx is a failure with that code as exit code
+type httpBackend struct {
+	client *http.Client
+}
+
+func (b httpBackend) Run(ctx context.Context, cmd Command, limit int) (res Result, err error) {
+	fields := strings.Fields(cmd.Command)
+	if len(fields) < 2 || len(fields) > 3 {
+		log.Printf("Invalid http command [%s], expected METHOD URL [{file}]\n", cmd.Command)
+		return internalError()
+	}
+	method, url := strings.ToUpper(fields[0]), fields[1]
+
+	var body io.Reader
+	if len(fields) == 3 {
+		match := cmdWithFilesRE.FindStringSubmatch(fields[2])
+		if match == nil || match[0] != fields[2] {
+			log.Printf("Invalid body [%s], expected a {file}\n", fields[2])
+			return internalError()
+		}
+		content, ok := cmd.Files[match[1]]
+		if !ok {
+			log.Printf("Missing file %s for the body\n", match[1])
+			return internalError()
+		}
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		log.Printf("Couldn't create request [%s]: %v\n", cmd.Command, err)
+		return internalError()
+	}
+	for _, header := range cmd.Args {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			log.Printf("Invalid header [%s], expected Name: value\n", header)
+			return internalError()
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		log.Printf("Couldn't run [%s]: %v\n", cmd.Command, err)
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			res.ErrorClass = ErrorTimeout
+		case context.Canceled:
+			res.ErrorClass = ErrorCanceled
+		default:
+			res.ErrorClass = ErrorInternal
+		}
+		return res, fmt.Errorf("internal error")
+	}
+	defer resp.Body.Close()
+
+	out := &capture{limit: limit}
+	_, err = io.Copy(out.writer(&out.stdout), resp.Body)
+	if err != nil {
+		log.Printf("Couldn't read reply of [%s]: %v\n", cmd.Command, err)
+	}
+	res.Output = out.combined.String()
+	res.Stdout = out.stdout.String()
+	res.Truncated = out.truncated
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("[%s]: %s\n", cmd.Command, resp.Status)
+		res.ExitCode = resp.StatusCode
+		res.ErrorClass = ErrorExit
+		return res, &ExitError{Code: resp.StatusCode}
+	}
+	return res, nil
+}
@@ -0,0 +1,539 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cheops.com/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Where the service account of a pod is mounted
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The field manager of the objects applied by cheops
+const fieldManager = "cheops"
+
+// How often the rollout of workloads is checked when waiting for it
+var rolloutInterval = time.Second
+
+// RegisterKubernetes registers the kubernetes backend if the node can reach a
+// cluster, either the configured one or the one of the pod it runs in
+func RegisterKubernetes(cfg config.Kubernetes) error {
+	if cfg.Server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			log.Printf("No kubernetes cluster, the kubernetes backend is disabled\n")
+			return nil
+		}
+		cfg.Server = "https://" + net.JoinHostPort(host, port)
+		if cfg.Token == "" && cfg.TokenFile == "" {
+			cfg.TokenFile = path.Join(serviceAccountDir, "token")
+		}
+		if cfg.CA == "" {
+			cfg.CA = path.Join(serviceAccountDir, "ca.crt")
+		}
+	}
+
+	k, err := newKubernetesBackend(cfg)
+	if err != nil {
+		return err
+	}
+	Register(Kubernetes, k)
+	return nil
+}
+
+// kubernetesBackend applies, patches and deletes manifests through the REST
+// API of a cluster. Objects are applied server-side, so that the fields set
+// by others are left alone
+type kubernetesBackend struct {
+	cfg    config.Kubernetes
+	client *http.Client
+
+	sync.Mutex
+
+	// apiVersion -> kind -> resource, as discovered on the API server
+	resources map[string]map[string]apiResource
+}
+
+// apiResource is how the API server exposes a kind
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+// statusError is an error the API server replied with
+type statusError struct {
+	Code    int
+	Message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func newKubernetesBackend(cfg config.Kubernetes) (*kubernetesBackend, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read kubernetes CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate in kubernetes CA %s", cfg.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+	}
+	return &kubernetesBackend{
+		cfg:       cfg,
+		client:    &http.Client{Transport: transport},
+		resources: make(map[string]map[string]apiResource),
+	}, nil
+}
+
+func (k *kubernetesBackend) Run(ctx context.Context, cmd Command, limit int) (res Result, err error) {
+	fields := strings.Fields(cmd.Command)
+	if len(fields) < 2 {
+		log.Printf("Invalid kubernetes command [%s], expected ACTION {file}...\n", cmd.Command)
+		return internalError()
+	}
+	action := fields[0]
+	switch action {
+	case "apply", "patch", "delete":
+	default:
+		log.Printf("Invalid kubernetes action %s, expected apply, patch or delete\n", action)
+		return internalError()
+	}
+
+	namespace := k.cfg.Namespace
+	wait := false
+	for _, arg := range cmd.Args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Invalid option [%s], expected name=value\n", arg)
+			return internalError()
+		}
+		switch parts[0] {
+		case "namespace":
+			namespace = parts[1]
+		case "wait":
+			wait, err = strconv.ParseBool(parts[1])
+			if err != nil {
+				log.Printf("Invalid wait option: %v\n", err)
+				return internalError()
+			}
+		default:
+			log.Printf("Unknown option %s, expected namespace or wait\n", parts[0])
+			return internalError()
+		}
+	}
+
+	objects := make([]map[string]interface{}, 0)
+	for _, field := range fields[1:] {
+		match := cmdWithFilesRE.FindStringSubmatch(field)
+		if match == nil || match[0] != field {
+			log.Printf("Invalid manifest [%s], expected a {file}\n", field)
+			return internalError()
+		}
+		content, ok := cmd.Files[match[1]]
+		if !ok {
+			log.Printf("Missing manifest %s\n", match[1])
+			return internalError()
+		}
+		manifests, err := parseManifests(content)
+		if err != nil {
+			log.Printf("Invalid manifest %s: %v\n", match[1], err)
+			return internalError()
+		}
+		objects = append(objects, manifests...)
+	}
+
+	out := &capture{limit: limit}
+	res.Objects = make([]Object, 0)
+	for _, obj := range objects {
+		var o Object
+		o, err = k.runObject(ctx, action, obj, namespace, wait)
+		if o.Action != "" {
+			res.Objects = append(res.Objects, o)
+			fmt.Fprintln(out.writer(&out.stdout), o.describe())
+			log.Printf("[%s]: %s\n", cmd.Command, o.describe())
+		}
+		if err != nil {
+			fmt.Fprintf(out.writer(&out.stderr), "%s/%s: %v\n", strings.ToLower(o.Kind), o.Name, err)
+			log.Printf("Couldn't %s %s/%s: %v\n", action, strings.ToLower(o.Kind), o.Name, err)
+			break
+		}
+	}
+	res.Output = out.combined.String()
+	res.Stdout = out.stdout.String()
+	res.Stderr = out.stderr.String()
+	res.Truncated = out.truncated
+
+	if err == nil {
+		return res, nil
+	}
+	var serr *statusError
+	switch {
+	case errors.As(err, &serr):
+		res.ExitCode = serr.Code
+		res.ErrorClass = ErrorExit
+		return res, &ExitError{Code: serr.Code}
+	case ctx.Err() == context.DeadlineExceeded:
+		res.ErrorClass = ErrorTimeout
+	case ctx.Err() == context.Canceled:
+		res.ErrorClass = ErrorCanceled
+	default:
+		res.ErrorClass = ErrorInternal
+	}
+	return res, fmt.Errorf("internal error")
+}
+
+// parseManifests returns the objects of a yaml or json file, that can have
+// several documents and lists
+func parseManifests(content []byte) ([]map[string]interface{}, error) {
+	objects := make([]map[string]interface{}, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var obj map[string]interface{}
+		err := decoder.Decode(&obj)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			continue
+		}
+		if kind, _ := obj["kind"].(string); kind == "List" {
+			items, _ := obj["items"].([]interface{})
+			for _, item := range items {
+				if o, ok := item.(map[string]interface{}); ok {
+					objects = append(objects, o)
+				}
+			}
+			continue
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// runObject applies, patches or deletes the object
+func (k *kubernetesBackend) runObject(ctx context.Context, action string, obj map[string]interface{}, namespace string, wait bool) (o Object, err error) {
+	o.APIVersion, _ = obj["apiVersion"].(string)
+	o.Kind, _ = obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	o.Name, _ = metadata["name"].(string)
+	if o.APIVersion == "" || o.Kind == "" || o.Name == "" {
+		return o, fmt.Errorf("manifest without apiVersion, kind or metadata.name")
+	}
+
+	resource, err := k.resource(ctx, o.APIVersion, o.Kind)
+	if err != nil {
+		return o, err
+	}
+	if resource.Namespaced {
+		if ns, _ := metadata["namespace"].(string); ns != "" {
+			namespace = ns
+		}
+		o.Namespace = namespace
+		metadata["namespace"] = namespace
+	}
+	p := objectPath(o.APIVersion, resource, o.Namespace, o.Name)
+
+	if action == "delete" {
+		code, body, err := k.do(ctx, "DELETE", p, "", nil)
+		switch {
+		case err != nil:
+			return o, err
+		case code == http.StatusNotFound:
+			o.Action = "not-found"
+		case code < 300:
+			o.Action = "deleted"
+		default:
+			return o, statusErr(code, body)
+		}
+		return o, nil
+	}
+
+	code, body, err := k.do(ctx, "GET", p, "", nil)
+	var before string
+	switch {
+	case err != nil:
+		return o, err
+	case code == http.StatusOK:
+		before = resourceVersion(body)
+	case code != http.StatusNotFound:
+		return o, statusErr(code, body)
+	}
+
+	content, err := json.Marshal(obj)
+	if err != nil {
+		return o, err
+	}
+	query := "?fieldManager=" + fieldManager
+	contentType := "application/merge-patch+json"
+	if action == "apply" {
+		// JSON is yaml too
+		query += "&force=true"
+		contentType = "application/apply-patch+yaml"
+	}
+	code, body, err = k.do(ctx, "PATCH", p+query, contentType, content)
+	if err != nil {
+		return o, err
+	}
+	if code >= 300 {
+		return o, statusErr(code, body)
+	}
+
+	switch after := resourceVersion(body); {
+	case before == "":
+		o.Action = "created"
+	case before == after:
+		o.Action = "unchanged"
+	case action == "apply":
+		o.Action = "configured"
+	default:
+		o.Action = "patched"
+	}
+
+	o.Rollout, err = k.rollout(ctx, p, o.Kind, body, wait)
+	return o, err
+}
+
+// resource returns how the API server exposes the kind
+func (k *kubernetesBackend) resource(ctx context.Context, apiVersion, kind string) (apiResource, error) {
+	k.Lock()
+	r, ok := k.resources[apiVersion][kind]
+	k.Unlock()
+	if ok {
+		return r, nil
+	}
+
+	p := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		p = "/api/" + apiVersion
+	}
+	code, body, err := k.do(ctx, "GET", p, "", nil)
+	if err != nil {
+		return r, err
+	}
+	if code != http.StatusOK {
+		return r, statusErr(code, body)
+	}
+	var list struct {
+		Resources []apiResource `json:"resources"`
+	}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return r, fmt.Errorf("Invalid resources of %s: %v", apiVersion, err)
+	}
+
+	kinds := make(map[string]apiResource)
+	for _, resource := range list.Resources {
+		// Subresources, such as deployments/scale
+		if strings.Contains(resource.Name, "/") {
+			continue
+		}
+		kinds[resource.Kind] = resource
+	}
+	k.Lock()
+	k.resources[apiVersion] = kinds
+	k.Unlock()
+
+	r, ok = kinds[kind]
+	if !ok {
+		return r, fmt.Errorf("unknown kind %s in %s", kind, apiVersion)
+	}
+	return r, nil
+}
+
+// objectPath returns the path of the object on the API server
+func objectPath(apiVersion string, resource apiResource, namespace, name string) string {
+	p := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		p = "/api/" + apiVersion
+	}
+	if resource.Namespaced {
+		p += "/namespaces/" + url.PathEscape(namespace)
+	}
+	return p + "/" + resource.Name + "/" + url.PathEscape(name)
+}
+
+// do sends a request to the API server and returns the status code and the
+// body of the reply
+func (k *kubernetesBackend) do(ctx context.Context, method, p, contentType string, body []byte) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(k.cfg.Server, "/")+p, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	token := k.cfg.Token
+	if k.cfg.TokenFile != "" {
+		// Tokens of service accounts are renewed, they must be read again
+		content, err := os.ReadFile(k.cfg.TokenFile)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Couldn't read kubernetes token: %v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, content, err
+}
+
+// statusErr returns the error in the Status the API server replied with
+func statusErr(code int, body []byte) error {
+	var status struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil || status.Message == "" {
+		status.Message = http.StatusText(code)
+	}
+	return &statusError{Code: code, Message: status.Message}
+}
+
+// resourceVersion returns the version of the object
+func resourceVersion(body []byte) string {
+	var obj struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(body, &obj)
+	return obj.Metadata.ResourceVersion
+}
+
+// rollout returns how far the rollout of a workload is, or "" for other
+// objects. With wait, it waits until the rollout is complete
+func (k *kubernetesBackend) rollout(ctx context.Context, p, kind string, body []byte, wait bool) (string, error) {
+	for {
+		status, complete := rolloutStatus(kind, body)
+		if complete || !wait {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(rolloutInterval):
+		}
+
+		code, b, err := k.do(ctx, "GET", p, "", nil)
+		if err != nil {
+			return status, err
+		}
+		if code != http.StatusOK {
+			return status, statusErr(code, b)
+		}
+		body = b
+	}
+}
+
+// rolloutStatus returns how far the rollout of the workload is, and whether
+// it is complete. Objects that are not workloads are always complete
+func rolloutStatus(kind string, body []byte) (status string, complete bool) {
+	var w struct {
+		Metadata struct {
+			Generation int64 `json:"generation"`
+		} `json:"metadata"`
+		Spec struct {
+			Replicas *int64 `json:"replicas"`
+		} `json:"spec"`
+		Status struct {
+			ObservedGeneration int64 `json:"observedGeneration"`
+
+			Replicas          int64 `json:"replicas"`
+			UpdatedReplicas   int64 `json:"updatedReplicas"`
+			ReadyReplicas     int64 `json:"readyReplicas"`
+			AvailableReplicas int64 `json:"availableReplicas"`
+
+			DesiredNumberScheduled int64 `json:"desiredNumberScheduled"`
+			UpdatedNumberScheduled int64 `json:"updatedNumberScheduled"`
+			NumberAvailable        int64 `json:"numberAvailable"`
+		} `json:"status"`
+	}
+	json.Unmarshal(body, &w)
+
+	desired := int64(1)
+	if w.Spec.Replicas != nil {
+		desired = *w.Spec.Replicas
+	}
+	var updated, available int64
+	switch kind {
+	case "Deployment":
+		updated, available = w.Status.UpdatedReplicas, w.Status.AvailableReplicas
+		if w.Status.Replicas > updated {
+			// Old replicas are still there
+			available = 0
+		}
+	case "StatefulSet":
+		updated, available = w.Status.UpdatedReplicas, w.Status.ReadyReplicas
+	case "DaemonSet":
+		desired = w.Status.DesiredNumberScheduled
+		updated, available = w.Status.UpdatedNumberScheduled, w.Status.NumberAvailable
+	default:
+		return "", true
+	}
+
+	if w.Status.ObservedGeneration < w.Metadata.Generation {
+		return "waiting for the new generation to be observed", false
+	}
+	if updated < desired || available < desired {
+		return fmt.Sprintf("%d of %d updated, %d available", updated, desired, available), false
+	}
+	return "complete", true
+}
+
+// describe returns the object as kubectl shows it, such as
+// "deployment.apps/web configured"
+func (o Object) describe() string {
+	kind := strings.ToLower(o.Kind)
+	if parts := strings.SplitN(o.APIVersion, "/", 2); len(parts) == 2 {
+		kind += "." + parts[0]
+	}
+	s := fmt.Sprintf("%s/%s %s", kind, o.Name, o.Action)
+	if o.Rollout != "" {
+		s += " (rollout " + o.Rollout + ")"
+	}
+	return s
+}
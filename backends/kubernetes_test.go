@@ -0,0 +1,223 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cheops.com/config"
+)
+
+// fakeCluster is an API server that keeps its objects in memory. Workloads
+// are rolled out one GET after they are written
+type fakeCluster struct {
+	sync.Mutex
+
+	// path -> object
+	objects map[string]map[string]interface{}
+
+	// path -> last applied manifest
+	applied map[string]string
+
+	version int
+}
+
+var fakeResources = map[string]string{
+	"/api/v1":       `{"resources": [{"name": "services", "kind": "Service", "namespaced": true}, {"name": "services/status", "kind": "Service", "namespaced": true}, {"name": "namespaces", "kind": "Namespace", "namespaced": false}]}`,
+	"/apis/apps/v1": `{"resources": [{"name": "deployments", "kind": "Deployment", "namespaced": true}]}`,
+}
+
+func (c *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"kind": "Status", "code": 404, "message": "%s not found"}`, r.URL.Path)
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"kind": "Status", "code": 401, "message": "Unauthorized"}`)
+		return
+	}
+	if list, ok := fakeResources[r.URL.Path]; ok {
+		io.WriteString(w, list)
+		return
+	}
+
+	obj, exists := c.objects[r.URL.Path]
+	switch r.Method {
+	case "GET":
+		if !exists {
+			notFound()
+			return
+		}
+		if status, ok := obj["status"].(map[string]interface{}); ok {
+			spec := obj["spec"].(map[string]interface{})
+			status["updatedReplicas"] = spec["replicas"]
+			status["availableReplicas"] = spec["replicas"]
+		}
+	case "DELETE":
+		if !exists {
+			notFound()
+			return
+		}
+		delete(c.objects, r.URL.Path)
+		delete(c.applied, r.URL.Path)
+	case "PATCH":
+		body, _ := io.ReadAll(r.Body)
+		var patch map[string]interface{}
+		json.Unmarshal(body, &patch)
+		if r.URL.Query().Get("fieldManager") != fieldManager {
+			http.Error(w, "missing field manager", http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("Content-Type") {
+		case "application/apply-patch+yaml":
+			if c.applied[r.URL.Path] == string(body) {
+				break
+			}
+			c.applied[r.URL.Path] = string(body)
+			obj = merge(obj, patch)
+			c.write(r.URL.Path, obj)
+		case "application/merge-patch+json":
+			if !exists {
+				notFound()
+				return
+			}
+			obj = merge(obj, patch)
+			c.write(r.URL.Path, obj)
+		default:
+			http.Error(w, "unexpected patch", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(obj)
+}
+
+// write saves a new version of the object, not rolled out yet
+func (c *fakeCluster) write(p string, obj map[string]interface{}) {
+	c.version++
+	metadata := obj["metadata"].(map[string]interface{})
+	metadata["resourceVersion"] = fmt.Sprint(c.version)
+	generation, _ := metadata["generation"].(float64)
+	metadata["generation"] = generation + 1
+	if obj["kind"] == "Deployment" {
+		obj["status"] = map[string]interface{}{
+			"observedGeneration": generation + 1,
+		}
+	}
+	c.objects[p] = obj
+}
+
+// merge merges the patch into obj, as a merge patch
+func merge(obj, patch map[string]interface{}) map[string]interface{} {
+	if obj == nil {
+		obj = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		sub, ok := value.(map[string]interface{})
+		if current, okk := obj[key].(map[string]interface{}); ok && okk {
+			obj[key] = merge(current, sub)
+			continue
+		}
+		obj[key] = value
+	}
+	return obj
+}
+
+const fakeManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: front
+spec:
+  ports:
+  - port: 80
+`
+
+func TestRunKubernetes(t *testing.T) {
+	cluster := &fakeCluster{
+		objects: make(map[string]map[string]interface{}),
+		applied: make(map[string]string),
+	}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+	defer func(interval time.Duration) { rolloutInterval = interval }(rolloutInterval)
+	rolloutInterval = 10 * time.Millisecond
+
+	k, err := newKubernetesBackend(config.Kubernetes{Server: server.URL, Token: "secret", Namespace: "test"})
+	if err != nil {
+		t.Fatalf("Couldn't create backend: %v", err)
+	}
+	run := func(command string, args ...string) (Result, error) {
+		return k.Run(context.Background(), Command{
+			Backend: Kubernetes,
+			Command: command,
+			Args:    args,
+			Files: map[string][]byte{
+				"app.yml":   []byte(fakeManifest),
+				"patch.yml": []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 3\n"),
+			},
+		}, 0)
+	}
+	expect := func(res Result, err error, expected ...string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Couldn't run: %v (%s)", err, res.Output)
+		}
+		got := strings.Split(strings.TrimSpace(res.Stdout), "\n")
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	}
+
+	res, err := run("apply {app.yml}", "wait=true")
+	expect(res, err, "deployment.apps/web created (rollout complete)", "service/web created")
+	if len(res.Objects) != 2 || res.Objects[0].Namespace != "test" || res.Objects[1].Namespace != "front" {
+		t.Fatalf("Unexpected objects %+v", res.Objects)
+	}
+
+	res, err = run("apply {app.yml}")
+	expect(res, err, "deployment.apps/web unchanged (rollout complete)", "service/web unchanged")
+
+	res, err = run("patch {patch.yml}")
+	expect(res, err, "deployment.apps/web patched (rollout 0 of 3 updated, 0 available)")
+
+	res, err = run("delete {app.yml}", "namespace=test")
+	expect(res, err, "deployment.apps/web deleted", "service/web deleted")
+	res, err = run("delete {app.yml}")
+	expect(res, err, "deployment.apps/web not-found", "service/web not-found")
+
+	// Errors of the API server are the exit code
+	res, err = run("patch {patch.yml}")
+	if ExitCode(err) != http.StatusNotFound || res.ErrorClass != ErrorExit || !strings.Contains(res.Stderr, "not found") {
+		t.Fatalf("Expected a 404, got %v (%s, %s)", err, res.ErrorClass, res.Stderr)
+	}
+	k.cfg.Token = "wrong"
+	res, err = run("apply {app.yml}")
+	if ExitCode(err) != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401, got %v (%s)", err, res.Stderr)
+	}
+	k.cfg.Token = "secret"
+
+	res, err = run("apply {other.yml}")
+	if err == nil || res.ErrorClass != ErrorInternal {
+		t.Fatalf("Expected a missing manifest, got %v (%s)", err, res.ErrorClass)
+	}
+}
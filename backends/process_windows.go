@@ -0,0 +1,13 @@
+package backends
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing: there are no process groups to kill
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command; what it started keeps running
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
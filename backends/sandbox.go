@@ -0,0 +1,133 @@
+package backends
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cheops.com/config"
+)
+
+var (
+	sandboxLock sync.Mutex
+	sandbox     config.Sandbox
+)
+
+// SetSandbox restricts the processes of the commands run from now on by the
+// shell and exec backends. It fails if this node can't provide the sandbox
+func SetSandbox(cfg config.Sandbox) error {
+	if cfg.Enabled {
+		if usesBubblewrap(cfg) {
+			if _, err := exec.LookPath("bwrap"); err != nil {
+				return fmt.Errorf("Couldn't find bubblewrap for the sandbox: %v", err)
+			}
+		}
+		if cfg.Seccomp != "" {
+			if _, err := os.Stat(cfg.Seccomp); err != nil {
+				return fmt.Errorf("Invalid seccomp filter: %v", err)
+			}
+		}
+		if err := checkSandbox(cfg); err != nil {
+			return err
+		}
+	}
+
+	sandboxLock.Lock()
+	defer sandboxLock.Unlock()
+	sandbox = cfg
+	return nil
+}
+
+func currentSandbox() config.Sandbox {
+	sandboxLock.Lock()
+	defer sandboxLock.Unlock()
+	return sandbox
+}
+
+// usesBubblewrap returns true if the commands must be run in bubblewrap
+func usesBubblewrap(s config.Sandbox) bool {
+	return s.ReadOnlyRoot || s.Seccomp != ""
+}
+
+// sandboxed puts the process in the sandbox, if there is one. dir is the
+// working directory of the command, the only writable path with a read-only
+// root. The returned function must be called once the process is done
+func sandboxed(execCommand *exec.Cmd, dir string) (done func(), err error) {
+	done = func() {}
+	s := currentSandbox()
+	if !s.Enabled {
+		return
+	}
+
+	env := make([]string, 0, len(s.Environment))
+	for _, name := range s.Environment {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	if usesBubblewrap(s) {
+		env = append(env, "TMPDIR="+dir)
+	}
+	execCommand.Env = env
+
+	argv := append([]string{execCommand.Path}, execCommand.Args[1:]...)
+	if limits := ulimits(s); limits != "" {
+		// The limits are set by sh before it becomes the command
+		argv = append([]string{"sh", "-c", limits + ` && exec "$@"`, "sandbox"}, argv...)
+	}
+	if usesBubblewrap(s) {
+		bwrap := []string{"bwrap", "--ro-bind", "/", "/", "--dev", "/dev", "--bind", dir, dir, "--chdir", dir, "--die-with-parent"}
+		for _, namespace := range s.Namespaces {
+			switch namespace {
+			case "mount":
+				// bubblewrap always has its own
+			case "pid":
+				bwrap = append(bwrap, "--unshare-pid", "--proc", "/proc")
+			default:
+				bwrap = append(bwrap, "--unshare-"+namespace)
+			}
+		}
+		if s.Seccomp != "" {
+			f, err := os.Open(s.Seccomp)
+			if err != nil {
+				return done, fmt.Errorf("Couldn't open seccomp filter: %v", err)
+			}
+			done = func() { f.Close() }
+			execCommand.ExtraFiles = append(execCommand.ExtraFiles, f)
+			bwrap = append(bwrap, "--seccomp", strconv.Itoa(2+len(execCommand.ExtraFiles)))
+		}
+		argv = append(append(bwrap, "--"), argv...)
+	}
+
+	if argv[0] != execCommand.Path {
+		execCommand.Path, err = exec.LookPath(argv[0])
+		if err != nil {
+			return
+		}
+		execCommand.Args = argv
+	}
+	err = sandboxProcess(execCommand, dir, s)
+	return
+}
+
+// ulimits returns the sh commands that set the limits of the sandbox
+func ulimits(s config.Sandbox) string {
+	limits := make([]string, 0)
+	if s.CPUTime > 0 {
+		seconds := (s.CPUTime + time.Second - 1) / time.Second
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", seconds))
+	}
+	if s.Memory > 0 {
+		// In KiB
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", (s.Memory+1023)/1024))
+	}
+	if s.FileSize > 0 {
+		// In blocks of 512 bytes, for POSIX shells
+		limits = append(limits, fmt.Sprintf("ulimit -f %d", (s.FileSize+511)/512))
+	}
+	return strings.Join(limits, " && ")
+}
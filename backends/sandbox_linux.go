@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"cheops.com/config"
+)
+
+var cloneFlags = map[string]uintptr{
+	"user":  syscall.CLONE_NEWUSER,
+	"pid":   syscall.CLONE_NEWPID,
+	"net":   syscall.CLONE_NEWNET,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+	"mount": syscall.CLONE_NEWNS,
+}
+
+// checkSandbox returns an error if the sandbox can't be provided
+func checkSandbox(s config.Sandbox) error {
+	if usesBubblewrap(s) {
+		return nil
+	}
+	for _, namespace := range s.Namespaces {
+		if namespace == "user" && (s.UID != 0 || s.GID != 0) {
+			return fmt.Errorf("A sandbox user in a user namespace needs readonlyroot")
+		}
+	}
+	return nil
+}
+
+// sandboxProcess sets the user of the process, and its namespaces when
+// bubblewrap doesn't do it
+func sandboxProcess(cmd *exec.Cmd, dir string, s config.Sandbox) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	if s.UID != 0 || s.GID != 0 {
+		uid, gid := s.UID, s.GID
+		if uid == 0 {
+			uid = os.Getuid()
+		}
+		if gid == 0 {
+			gid = os.Getgid()
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+		// The working directory is the command's
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chown(p, uid, gid)
+		})
+		if err != nil {
+			return fmt.Errorf("Couldn't give the working directory to the sandbox user: %v", err)
+		}
+	}
+
+	if usesBubblewrap(s) {
+		return nil
+	}
+	for _, namespace := range s.Namespaces {
+		cmd.SysProcAttr.Cloneflags |= cloneFlags[namespace]
+	}
+	if cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWUSER != 0 {
+		// The command keeps its user, without any privilege outside
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package backends
+
+import (
+	"fmt"
+	"os/exec"
+
+	"cheops.com/config"
+)
+
+// checkSandbox returns an error if the sandbox can't be provided
+func checkSandbox(s config.Sandbox) error {
+	if s.UID != 0 || s.GID != 0 || (len(s.Namespaces) > 0 && !usesBubblewrap(s)) {
+		return fmt.Errorf("The sandbox only supports users and namespaces on linux")
+	}
+	return nil
+}
+
+// sandboxProcess does nothing: checkSandbox refused what needs linux
+func sandboxProcess(cmd *exec.Cmd, dir string, s config.Sandbox) error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package backends
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"cheops.com/config"
+)
+
+// withSandbox runs the commands of the test in the sandbox
+func withSandbox(t *testing.T, s config.Sandbox) {
+	t.Helper()
+	s.Enabled = true
+	if err := SetSandbox(s); err != nil {
+		t.Fatalf("Couldn't set sandbox: %v", err)
+	}
+	t.Cleanup(func() { SetSandbox(config.Sandbox{}) })
+}
+
+func TestSandboxEnvironment(t *testing.T) {
+	os.Setenv("CHEOPS_TEST_SECRET", "secret")
+	os.Setenv("CHEOPS_TEST_ALLOWED", "allowed")
+	defer os.Unsetenv("CHEOPS_TEST_SECRET")
+	defer os.Unsetenv("CHEOPS_TEST_ALLOWED")
+	withSandbox(t, config.Sandbox{Environment: []string{"PATH", "CHEOPS_TEST_ALLOWED"}})
+
+	for _, cmd := range []Command{{Command: "env"}, {Backend: Exec, Command: "env"}} {
+		res, err := Run(context.Background(), cmd, 0)
+		if err != nil {
+			t.Fatalf("Couldn't run: %v (%s)", err, res.Output)
+		}
+		if !strings.Contains(res.Stdout, "CHEOPS_TEST_ALLOWED=allowed") || strings.Contains(res.Stdout, "secret") {
+			t.Fatalf("Expected only the allowed variables, got %s", res.Stdout)
+		}
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	withSandbox(t, config.Sandbox{Environment: []string{"PATH"}, FileSize: 4096})
+
+	res, err := Run(context.Background(), Command{Command: "head -c 1000 /dev/zero > small"}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write a small file: %v (%s)", err, res.Output)
+	}
+	res, err = Run(context.Background(), Command{Command: "head -c 100000 /dev/zero > big"}, 0)
+	if err == nil {
+		t.Fatalf("Expected the file size limit to stop the command")
+	}
+	res, err = Run(context.Background(), Command{Backend: Exec, Command: "sh", Args: []string{"-c", "ulimit -f"}}, 0)
+	if err != nil || strings.TrimSpace(res.Stdout) != "8" {
+		t.Fatalf("Expected the limit for exec too, got %v (%s)", err, res.Output)
+	}
+}
+
+func TestSandboxNamespaces(t *testing.T) {
+	withSandbox(t, config.Sandbox{Environment: []string{"PATH"}, Namespaces: []string{"net"}})
+
+	res, err := Run(context.Background(), Command{Command: "cat /proc/net/dev"}, 0)
+	if res.ErrorClass == ErrorInternal {
+		t.Skipf("Namespaces are not available here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Couldn't run: %v (%s)", err, res.Output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(res.Stdout), "\n")[2:] {
+		if !strings.HasPrefix(strings.TrimSpace(line), "lo:") {
+			t.Fatalf("Expected only the loopback interface, got %s", res.Stdout)
+		}
+	}
+}
+
+func TestSandboxReadOnlyRoot(t *testing.T) {
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		if err := SetSandbox(config.Sandbox{Enabled: true, ReadOnlyRoot: true}); err == nil {
+			t.Fatalf("Expected an error without bubblewrap")
+		}
+		t.Skip("bubblewrap is not installed")
+	}
+	withSandbox(t, config.Sandbox{Environment: []string{"PATH"}, ReadOnlyRoot: true})
+
+	res, err := Run(context.Background(), Command{Command: "echo ok > file && cat file"}, 0)
+	if err != nil || res.Stdout != "ok\n" {
+		t.Fatalf("Expected the working directory to be writable, got %v (%s)", err, res.Output)
+	}
+	res, err = Run(context.Background(), Command{Command: "touch /cheops-sandbox-test"}, 0)
+	if err == nil {
+		os.Remove("/cheops-sandbox-test")
+		t.Fatalf("Expected the root to be read-only")
+	}
+}
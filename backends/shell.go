@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,97 +14,192 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var cmdWithFilesRE = regexp.MustCompile("{([^}]+)}")
 
-// A Command is a command with the files it needs
-type ShellCommand struct {
-	Command string
-	Files   map[string][]byte
+func init() {
+	Register(Shell, shellBackend{})
 }
 
-// runWithStdin runs a command with an input to be passed to standard input and returns the combined output (stdout and stderr) as a slice of bytes and an error.
-// The command is run in a temporary directory that is removed at the end. This temporary directory contains all files given in input
+// shellBackend runs commands with sh
+type shellBackend struct{}
+
+func (shellBackend) Run(ctx context.Context, cmd Command, limit int) (Result, error) {
+	return runWithStdin(ctx, cmd, limit)
+}
+
+// runWithStdin runs a command with an input to be passed to standard input and returns what it wrote and an error.
+// The command is run in a temporary directory that is removed at the end. This temporary directory contains all files given in input.
+// Each output is cut to limit bytes, unless limit is 0.
 //
 // If the command was run successfully with no error, err is null.
-// If the command was run successfully with a status code != 0, the error is a generic "failed". Note that stderr is included in the output
+// If the command was run successfully with a status code != 0, the error is an *ExitError.
 // If there was an error in running the command (command not found, ...) then the error is a generic "internal error". The underlying error is logged.
-func runWithStdin(ctx context.Context, cmd ShellCommand) (output string, err error) {
-	dir, err := ioutil.TempDir("", "cheops.tmp.*")
+func runWithStdin(ctx context.Context, cmd Command, limit int) (res Result, err error) {
+	dir, replace, err := workingDir(cmd)
 	if err != nil {
-		log.Printf("Couldn't create tmp dir: %v\n", err)
-		return "", fmt.Errorf("internal error")
+		return internalError()
 	}
 	defer os.RemoveAll(dir)
 
+	input := replace(cmd.Command)
+
+	execCommand := exec.Command("sh")
+	execCommand.Dir = dir
+
+	stdin, err := execCommand.StdinPipe()
+	if err != nil {
+		log.Printf("Couldn't get stdin: %v\n", err)
+		return internalError()
+	}
+
+	go func() {
+		defer stdin.Close()
+		io.WriteString(stdin, input)
+	}()
+
+	return runProcess(ctx, execCommand, input, limit)
+}
+
+// internalError is what a command that couldn't be prepared gives
+func internalError() (Result, error) {
+	return Result{ErrorClass: ErrorInternal}, fmt.Errorf("internal error")
+}
+
+// workingDir creates a temporary directory with the files of the command,
+// and returns it with a function that replaces every {file} in a string
+// with the path of the file
+func workingDir(cmd Command) (dir string, replace func(string) string, err error) {
+	dir, err = ioutil.TempDir("", "cheops.tmp.*")
+	if err != nil {
+		log.Printf("Couldn't create tmp dir: %v\n", err)
+		return
+	}
+
 	// filename -> tmp full path
 	replacements := make(map[string]string)
 	for filename, file := range cmd.Files {
 		fullpath := path.Join(dir, filename)
-		err := ioutil.WriteFile(fullpath, file, 0644)
+		err = ioutil.WriteFile(fullpath, file, 0644)
 		if err != nil {
 			log.Printf("Couldn't write working file %s: %v\n", file, err)
-			return "", fmt.Errorf("internal error")
+			os.RemoveAll(dir)
+			return
 		}
 		replacements[filename] = fullpath
 	}
 
-	// replace all patterns
-
-	input := cmd.Command
-	matches := cmdWithFilesRE.FindAllStringSubmatch(cmd.Command, -1)
-	for _, match := range matches {
-		input = strings.Replace(input, match[0], replacements[match[1]], 1)
+	replace = func(s string) string {
+		matches := cmdWithFilesRE.FindAllStringSubmatch(s, -1)
+		for _, match := range matches {
+			s = strings.Replace(s, match[0], replacements[match[1]], 1)
+		}
+		return s
 	}
+	return
+}
 
-	execCommand := exec.CommandContext(ctx, "sh")
-	execCommand.Dir = dir
-
-	stdin, err := execCommand.StdinPipe()
+// runProcess runs the process in the sandbox and returns what it gave; name
+// is how the process appears in the logs. When ctx is done, the process and
+// all the processes it started are killed
+func runProcess(ctx context.Context, execCommand *exec.Cmd, name string, limit int) (res Result, err error) {
+	setProcessGroup(execCommand)
+	cleanup, err := sandboxed(execCommand, execCommand.Dir)
 	if err != nil {
-		log.Printf("Couldn't get stdin: %v\n", err)
-		return "", fmt.Errorf("internal error")
+		log.Printf("Couldn't sandbox [%s]: %v\n", name, err)
+		return internalError()
 	}
+	defer cleanup()
 
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, input)
-	}()
-
-	out, err := execCommand.CombinedOutput()
+	out := &capture{limit: limit}
+	execCommand.Stdout = out.writer(&out.stdout)
+	execCommand.Stderr = out.writer(&out.stderr)
+	err = execCommand.Start()
+	if err == nil {
+		// When ctx is done, everything the command started is killed:
+		// killing only sh would leave its children running, and holding
+		// the outputs
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(execCommand)
+			case <-done:
+			}
+		}()
+		err = execCommand.Wait()
+		close(done)
+	}
 	if err != nil {
-		log.Printf("Couldn't run [%s]: %v\n", input, err)
+		log.Printf("Couldn't run [%s]: %v\n", name, err)
+		res.ErrorClass = ErrorInternal
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			res.ErrorClass = ErrorNotFound
+		}
 		err = fmt.Errorf("internal error")
 	}
-	scanner := bufio.NewScanner(bytes.NewBuffer(out))
+	scanner := bufio.NewScanner(bytes.NewBuffer(out.combined.Bytes()))
 	for scanner.Scan() {
-		log.Printf("[%s]: %s\n", input, scanner.Text())
+		log.Printf("[%s]: %s\n", name, scanner.Text())
 	}
 
-	if execCommand.ProcessState != nil && !execCommand.ProcessState.Success() {
-		err = fmt.Errorf("failed")
+	res.Output = out.combined.String()
+	res.Stdout = out.stdout.String()
+	res.Stderr = out.stderr.String()
+	res.Truncated = out.truncated
+
+	if state := execCommand.ProcessState; state != nil && !state.Success() {
+		res.ExitCode = state.ExitCode()
+		err = &ExitError{Code: res.ExitCode}
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			res.ErrorClass = ErrorTimeout
+		case ctx.Err() == context.Canceled:
+			res.ErrorClass = ErrorCanceled
+		case res.ExitCode == -1:
+			res.ErrorClass = ErrorKilled
+		case res.ExitCode == 127:
+			// What sh says when it can't find the command
+			res.ErrorClass = ErrorNotFound
+		default:
+			res.ErrorClass = ErrorExit
+		}
 	}
 
-	return string(out), err
+	return res, err
 }
 
-func Handle(ctx context.Context, commands []ShellCommand) (replies []string, err error) {
-	replies = make([]string, 0)
-	doRun := true
-
-	for i, cmd := range commands {
-		var output string
-		if doRun {
-			out, err2 := runWithStdin(ctx, cmd)
-			if err2 != nil {
-				err = err2
-				doRun = false
-				log.Printf("Error running command %d, skipping %d\n", i+1, len(commands)-i-1)
-			}
-			output = out
+// capture keeps what a command writes, up to limit bytes for each output
+type capture struct {
+	sync.Mutex
+	limit int
+
+	combined, stdout, stderr bytes.Buffer
+	truncated                bool
+}
+
+type captureWriter struct {
+	c *capture
+	b *bytes.Buffer
+}
+
+// writer returns a writer that writes to b and to the combined output
+func (c *capture) writer(b *bytes.Buffer) io.Writer {
+	return captureWriter{c: c, b: b}
+}
+
+func (w captureWriter) Write(p []byte) (int, error) {
+	w.c.Lock()
+	defer w.c.Unlock()
+	for _, b := range []*bytes.Buffer{w.b, &w.c.combined} {
+		keep := p
+		if w.c.limit > 0 && b.Len()+len(keep) > w.c.limit {
+			keep = keep[:w.c.limit-b.Len()]
+			w.c.truncated = true
 		}
-		replies = append(replies, output)
+		b.Write(keep)
 	}
-	return replies, err
+	return len(p), nil
 }
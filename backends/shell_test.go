@@ -5,10 +5,11 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestHandleSimple(t *testing.T) {
-	commands := []ShellCommand{{Command: "echo -n foo"}}
+	commands := []Command{{Command: "echo -n foo"}}
 	replies, err := Handle(context.Background(), commands)
 	if err != nil {
 		t.Fatalf("Error when executing cmd: %v\n", err)
@@ -28,7 +29,7 @@ func TestHandleRedirect(t *testing.T) {
 		os.RemoveAll("/tmp/cheopstest")
 	}()
 
-	bodies := []ShellCommand{{Command: "mkdir /tmp/cheopstest"}, {Command: "echo something > /tmp/cheopstest/file"}}
+	bodies := []Command{{Command: "mkdir /tmp/cheopstest"}, {Command: "echo something > /tmp/cheopstest/file"}}
 	replies, err := Handle(context.Background(), bodies)
 	if err != nil {
 		t.Fatalf("Error when executing cmd: %v\noutputs: %v", err, replies)
@@ -46,3 +47,54 @@ func TestHandleRedirect(t *testing.T) {
 		t.Fatalf("Invalid content, got [%v], expected [something\\n]\n", content)
 	}
 }
+
+func TestHandleExitCode(t *testing.T) {
+	_, err := Handle(context.Background(), []Command{{Command: "exit 3"}})
+	if code := ExitCode(err); code != 3 {
+		t.Fatalf("Expected exit code 3, got %d (%v)", code, err)
+	}
+	if code := ExitCode(nil); code != 0 {
+		t.Fatalf("Expected exit code 0 without error, got %d", code)
+	}
+}
+
+func TestRunOutputs(t *testing.T) {
+	res, err := Run(context.Background(), Command{Command: "echo out; echo err >&2; exit 4"}, 0)
+	if ExitCode(err) != 4 || res.ExitCode != 4 || res.ErrorClass != ErrorExit {
+		t.Fatalf("Expected exit code 4, got %d (%v, %s)", res.ExitCode, err, res.ErrorClass)
+	}
+	// The order of close writes to stdout and stderr isn't kept
+	if res.Stdout != "out\n" || res.Stderr != "err\n" || (res.Output != "out\nerr\n" && res.Output != "err\nout\n") {
+		t.Fatalf("Invalid outputs: stdout=%q stderr=%q output=%q", res.Stdout, res.Stderr, res.Output)
+	}
+	if res.Duration <= 0 {
+		t.Fatalf("Expected a duration, got %v", res.Duration)
+	}
+
+	res, _ = Run(context.Background(), Command{Command: "echo 0123456789"}, 4)
+	if res.Stdout != "0123" || !res.Truncated {
+		t.Fatalf("Expected a truncated output, got %q (truncated=%v)", res.Stdout, res.Truncated)
+	}
+
+	res, _ = Run(context.Background(), Command{Command: "this-command-does-not-exist"}, 0)
+	if res.ErrorClass != ErrorNotFound {
+		t.Fatalf("Expected %s, got %s", ErrorNotFound, res.ErrorClass)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, _ = Run(ctx, Command{Command: "sleep 5; echo done"}, 0)
+	if res.ErrorClass != ErrorTimeout {
+		t.Fatalf("Expected %s, got %s", ErrorTimeout, res.ErrorClass)
+	}
+	if res.Duration > time.Second {
+		t.Fatalf("The children of the command were not killed, it ran for %v", res.Duration)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res, _ = Run(ctx, Command{Command: "sleep 5"}, 0)
+	if res.ErrorClass != ErrorCanceled {
+		t.Fatalf("Expected %s, got %s", ErrorCanceled, res.ErrorClass)
+	}
+}
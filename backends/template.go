@@ -0,0 +1,121 @@
+package backends
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cheops.com/config"
+)
+
+// Names of the files that parameters can designate: they end up in commands
+var fileParameterRE = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Expand returns the command of the template with the given parameters. The
+// parameters are checked against their definition, and quoted for the
+// backend when they go in its command
+func Expand(t config.Template, params map[string]string, files map[string][]byte) (Command, error) {
+	definitions := make(map[string]config.Parameter)
+	for _, p := range t.Parameters {
+		definitions[p.Name] = p
+	}
+	for name := range params {
+		if _, ok := definitions[name]; !ok {
+			return Command{}, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+
+	values := make(map[string]string)
+	for _, p := range t.Parameters {
+		value, ok := params[p.Name]
+		if !ok {
+			if p.Required {
+				return Command{}, fmt.Errorf("missing parameter %s", p.Name)
+			}
+			value = p.Default
+		}
+		value, err := checkParameter(p, value, files)
+		if err != nil {
+			return Command{}, fmt.Errorf("invalid parameter %s: %v", p.Name, err)
+		}
+		values[p.Name] = value
+	}
+
+	cmd := Command{
+		Backend:  t.Backend,
+		Files:    files,
+		Template: t.Name,
+		Params:   params,
+	}
+	cmd.Command = config.ReplacePlaceholders(t.Command, func(name string) string {
+		if definitions[name].Type == config.ParameterFile {
+			return values[name]
+		}
+		switch cmd.BackendName() {
+		case Shell:
+			return shellQuote(values[name])
+		case HTTP:
+			return url.QueryEscape(values[name])
+		default:
+			return values[name]
+		}
+	})
+	for _, arg := range t.Args {
+		cmd.Args = append(cmd.Args, config.ReplacePlaceholders(arg, func(name string) string {
+			return values[name]
+		}))
+	}
+	return cmd, nil
+}
+
+// checkParameter checks the value against the definition of the parameter,
+// and returns what goes in the command
+func checkParameter(p config.Parameter, value string, files map[string][]byte) (string, error) {
+	if len(p.Values) > 0 {
+		allowed := false
+		for _, v := range p.Values {
+			allowed = allowed || v == value
+		}
+		if !allowed {
+			return "", fmt.Errorf("%q is not one of %s", value, strings.Join(p.Values, ", "))
+		}
+	}
+
+	switch p.Type {
+	case config.ParameterInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "", fmt.Errorf("%q is not an integer", value)
+		}
+	case config.ParameterBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "", fmt.Errorf("%q is not a boolean", value)
+		}
+	case config.ParameterFile:
+		name := strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")
+		if !fileParameterRE.MatchString(name) {
+			return "", fmt.Errorf("%q is not a valid file name", value)
+		}
+		if _, ok := files[name]; !ok {
+			return "", fmt.Errorf("file %s wasn't sent", name)
+		}
+		// Replaced by the path of the file when the command runs
+		return "{" + name + "}", nil
+	default:
+		if p.Pattern != "" && !regexp.MustCompile("^(?:"+p.Pattern+")$").MatchString(value) {
+			return "", fmt.Errorf("%q doesn't match %s", value, p.Pattern)
+		}
+	}
+
+	// Braces would designate files
+	if strings.ContainsAny(value, "{}") {
+		return "", fmt.Errorf("%q has braces", value)
+	}
+	return value, nil
+}
+
+// shellQuote quotes s so that sh takes it as a single word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
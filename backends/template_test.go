@@ -0,0 +1,74 @@
+package backends
+
+import (
+	"context"
+	"testing"
+
+	"cheops.com/config"
+)
+
+func TestExpand(t *testing.T) {
+	greet := config.Template{
+		Name:    "greet",
+		Command: "echo {{greeting}} {{ name }} {{times}}",
+		Parameters: []config.Parameter{
+			{Name: "greeting", Values: []string{"hello", "bye"}, Default: "hello"},
+			{Name: "name", Pattern: "[a-z ;'/-]+", Required: true},
+			{Name: "times", Type: config.ParameterInt, Default: "1"},
+		},
+	}
+	apply := config.Template{
+		Name:       "apply",
+		Backend:    Kubernetes,
+		Command:    "apply {{manifest}}",
+		Args:       []string{"namespace={{namespace}}"},
+		Parameters: []config.Parameter{{Name: "manifest", Type: config.ParameterFile, Required: true}, {Name: "namespace", Default: "default"}},
+	}
+	files := map[string][]byte{"app.yml": []byte("kind: Service")}
+
+	vectors := []struct {
+		t        config.Template
+		params   map[string]string
+		expected string
+		args     string
+	}{
+		{greet, map[string]string{"name": "bob"}, "echo 'hello' 'bob' '1'", ""},
+		{greet, map[string]string{"name": "bob; rm -rf '/", "greeting": "bye", "times": "2"}, `echo 'bye' 'bob; rm -rf '\''/' '2'`, ""},
+		{greet, map[string]string{}, "", ""},
+		{greet, map[string]string{"name": "bob", "other": "x"}, "", ""},
+		{greet, map[string]string{"name": "BOB"}, "", ""},
+		{greet, map[string]string{"name": "bob", "greeting": "hi"}, "", ""},
+		{greet, map[string]string{"name": "bob", "times": "x"}, "", ""},
+		{apply, map[string]string{"manifest": "app.yml"}, "apply {app.yml}", "namespace=default"},
+		{apply, map[string]string{"manifest": "{app.yml}", "namespace": "front"}, "apply {app.yml}", "namespace=front"},
+		{apply, map[string]string{"manifest": "other.yml"}, "", ""},
+		{apply, map[string]string{"manifest": "../app.yml"}, "", ""},
+		{apply, map[string]string{"manifest": "app.yml", "namespace": "{app.yml}"}, "", ""},
+	}
+	for i, v := range vectors {
+		cmd, err := Expand(v.t, v.params, files)
+		if v.expected == "" {
+			if err == nil {
+				t.Fatalf("vector %d: expected an error, got %q", i, cmd.Command)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vector %d: couldn't expand: %v", i, err)
+		}
+		args := ""
+		if len(cmd.Args) > 0 {
+			args = cmd.Args[0]
+		}
+		if cmd.Command != v.expected || args != v.args || cmd.Backend != v.t.Backend {
+			t.Fatalf("vector %d: expected %q %q, got %q %q", i, v.expected, v.args, cmd.Command, args)
+		}
+	}
+
+	// The quoted values are single words for the shell
+	cmd, _ := Expand(greet, map[string]string{"name": "bob; echo 'injected"}, nil)
+	res, err := Run(context.Background(), cmd, 0)
+	if err != nil || res.Stdout != "hello bob; echo 'injected 1\n" {
+		t.Fatalf("Expected a single echo, got %v (%q)", err, res.Output)
+	}
+}
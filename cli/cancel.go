@@ -0,0 +1,37 @@
+// cancel.go kills the command of a request while it runs on a site. The
+// site replies KO for it, and doesn't run it again.
+//
+// Usage:
+// $ cli cancel <request-id> --site S1
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alecthomas/kong"
+)
+
+type CancelCmd struct {
+	RequestId string `arg:"" help:"The id of the request"`
+	Site      string `help:"The site where the command runs" required:""`
+}
+
+func (c *CancelCmd) Run(ctx *kong.Context) error {
+	u := fmt.Sprintf("%s://%s:8079/cancel/%s", scheme, c.Site, url.PathEscape(c.RequestId))
+	res, err := http.Post(u, "", nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("No command of request %s is running on %s\n", c.RequestId, c.Site)
+	}
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, res.Status)
+	}
+	fmt.Printf("Canceled %s on %s\n", c.RequestId, c.Site)
+	return nil
+}
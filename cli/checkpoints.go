@@ -0,0 +1,63 @@
+// checkpoints.go shows where the watchers of a site are in the changes feed
+// of the database. With --reset, they go through the whole database again,
+// as they did before checkpoints were saved.
+//
+// Usage:
+// $ cli checkpoints --site S1 [--reset] [--watcher requests]
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/alecthomas/kong"
+)
+
+type CheckpointsCmd struct {
+	Site    string `help:"The site to look at" required:""`
+	Reset   bool   `help:"Process the whole database again"`
+	Watcher string `help:"Only reset this watcher"`
+}
+
+func (c *CheckpointsCmd) Run(ctx *kong.Context) error {
+	method := "GET"
+	u := fmt.Sprintf("%s://%s:8079/checkpoints", scheme, c.Site)
+	if c.Reset {
+		method = "DELETE"
+		if c.Watcher != "" {
+			u += "/" + url.PathEscape(c.Watcher)
+		}
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return fmt.Errorf("Error building request for %s: %v\n", u, err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, res.Status)
+	}
+
+	var checkpoints map[string]string
+	err = json.NewDecoder(res.Body).Decode(&checkpoints)
+	if err != nil {
+		return fmt.Errorf("Invalid reply: %v\n", err)
+	}
+	names := make([]string, 0, len(checkpoints))
+	for name := range checkpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s\t%s\n", name, checkpoints[name])
+	}
+	return nil
+}
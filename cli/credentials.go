@@ -0,0 +1,72 @@
+// credentials.go gives the tokens that authenticate the cli on the sites.
+// They come from --token, or from the credentials file:
+//
+//	# Used for the sites that are not listed
+//	token: "..."
+//	sites:
+//	  S1: "..."
+//	  S2: "..."
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type credentials struct {
+	Token string            `yaml:"token"`
+	Sites map[string]string `yaml:"sites"`
+}
+
+// loadCredentials reads the credentials file, if there is one. The token,
+// if not empty, is used for every site
+func loadCredentials(path, token string) (credentials, error) {
+	var creds credentials
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return creds, fmt.Errorf("Couldn't read credentials %s: %v", path, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(content, &creds); err != nil {
+			return creds, fmt.Errorf("Couldn't parse credentials %s: %v", path, err)
+		}
+	}
+	if token != "" {
+		creds = credentials{Token: token}
+	}
+	return creds, nil
+}
+
+// tokenFor returns the token to send to the site
+func (c credentials) tokenFor(site string) string {
+	if token, ok := c.Sites[site]; ok {
+		return token
+	}
+	return c.Token
+}
+
+// transport adds the token of the site to the requests sent to it
+type transport struct {
+	creds credentials
+	next  http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	site := req.URL.Host
+	if host, _, err := net.SplitHostPort(site); err == nil {
+		site = host
+	}
+	token := t.creds.tokenFor(site)
+	if token == "" || req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request it is given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(req)
+}
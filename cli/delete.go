@@ -0,0 +1,47 @@
+// delete.go deletes a resource from all its locations. The cleanup command of
+// the resource is run everywhere before the resource is forgotten, unless
+// another command is given.
+//
+// Usage:
+// $ cli delete --id my-deployment --site S1 [--command "kubectl delete deployment my-deployment"]
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+
+	"github.com/alecthomas/kong"
+)
+
+type DeleteCmd struct {
+	Id      string `help:"id of the resource" required:""`
+	Site    string `help:"A site where the resource exists" required:""`
+	Command string `help:"Cleanup command to run instead of the one in the resource config"`
+}
+
+func (d *DeleteCmd) Run(ctx *kong.Context) error {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	if d.Command != "" {
+		err := mw.WriteField("command", d.Command)
+		if err != nil {
+			return fmt.Errorf("Error with command: %v\n", err)
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		return fmt.Errorf("Error with form: %v\n", err)
+	}
+
+	if d.Id != url.PathEscape(d.Id) {
+		return fmt.Errorf("id has url-unsafe characters, please choose something else")
+	}
+	u, err := url.Parse(fmt.Sprintf("%s://%s:8079/exec/%s", scheme, d.Site, d.Id))
+	if err != nil {
+		return fmt.Errorf("Invalid parameters for site or id: %v\n", err)
+	}
+	return doRequest("DELETE", u.String(), mw.Boundary(), b, 0)
+}
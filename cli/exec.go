@@ -1,10 +1,23 @@
 // exec.go allows executing a command on a given resource and given locations
 //
 // Usage:
-// $ cli --id=my-deployment --command "kubectl create deployment {deployment.yml}" --type 3 --sites "S1&S2" --local-logic ll.cue --config config.json
+// $ cli --id=my-deployment --command "kubectl create deployment {deployment.yml}" --type 3 --sites "S1&S2" --local-logic ll.cue --config config.json [--timeout 2m] [--command-timeout 30s] [--async]
 //
 // In the command, any file wrapped with {} will be sent in the request (so that it can be used remotely).
+// --backend exec runs the program of --command with the --arg arguments, without a shell;
+// --backend http sends the "METHOD URL [{body-file}]" request of --command, with --arg headers:
+// $ cli exec --id counter --backend http --command "POST http://localhost:8080/counter?type=counter&operation=add&value=1" --type 2 --sites "S1&S2"
+// --backend kubernetes applies, patches or deletes manifests through the API server of the cluster of each site,
+// with --arg namespace=... and --arg wait=true to wait for the rollout of workloads:
+// $ cli exec --id my-deployment --backend kubernetes --command "apply {deployment.yml}" --arg wait=true --type 3 --sites "S1&S2" --fields status,site,objects
+// Nodes that only run the templates of their configuration get --template instead of --command:
+// $ cli exec --id my-deployment --template apply --param manifest={deployment.yml} --param namespace=front --type 3 --sites "S1&S2"
 // The local-logic and config file must exist; they will also be sent.
+// With --command-timeout, the command is killed on a site where it runs for
+// longer, and that site replies TIMEOUT.
+// With --async, only the request id is printed; use `cli status` to follow it.
+// --fields chooses what is printed of each reply, for example
+// --fields status,site,exitcode,duration,error,stderr
 
 package main
 
@@ -26,6 +39,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
@@ -33,12 +47,20 @@ import (
 var cmdWithFilesRE = regexp.MustCompile("{([^}]+)}")
 
 type ExecCmd struct {
-	Command    string `help:"Command to run" required:"" short:""`
-	Type       string `help:"The type of the command to run"`
-	Sites      string `help:"sites to deploy to, separated by an &" required:""`
-	Id         string `help:"id of the resource" required:""`
-	LocalLogic string `help:"Local logic file"`
-	Config     string `help:"config file"`
+	Command        string        `help:"Command to run, if the node accepts raw commands" short:""`
+	Template       string        `help:"Name of the template of the node to run instead of a command"`
+	Param          []string      `help:"Parameter of the template, as name=value; files are given as name={path} (repeatable)" sep:"none"`
+	Backend        string        `help:"Backend that runs the command: shell (the default), exec, http or kubernetes"`
+	Arg            []string      `help:"Argument of the command, for the exec, http and kubernetes backends (repeatable)" sep:"none"`
+	Type           string        `help:"The type of the command to run"`
+	Sites          string        `help:"sites to deploy to, separated by an &" required:""`
+	Id             string        `help:"id of the resource" required:""`
+	LocalLogic     string        `help:"Local logic file"`
+	Config         string        `help:"config file"`
+	Timeout        time.Duration `help:"How long to wait for the replies of all sites, instead of the default of the node"`
+	CommandTimeout time.Duration `help:"How long the command can run on each site before it is killed"`
+	Async          bool          `help:"Don't wait for the replies, only print the request id"`
+	Fields         []string      `help:"Fields of the replies to print, among status, request, site, attempt, exitcode, duration, error, truncated, objects, identity, output, stdout and stderr" default:"status,request,site,output"`
 }
 
 func (e *ExecCmd) Run(ctx *kong.Context) error {
@@ -57,6 +79,27 @@ func (e *ExecCmd) Run(ctx *kong.Context) error {
 		return fmt.Errorf("Error with sites: %v\n", err)
 	}
 
+	if e.Timeout > 0 {
+		err = mw.WriteField("timeout", e.Timeout.String())
+		if err != nil {
+			return fmt.Errorf("Error with timeout: %v\n", err)
+		}
+	}
+
+	if e.CommandTimeout > 0 {
+		err = mw.WriteField("commandtimeout", e.CommandTimeout.String())
+		if err != nil {
+			return fmt.Errorf("Error with command timeout: %v\n", err)
+		}
+	}
+
+	if e.Async {
+		err = mw.WriteField("async", "true")
+		if err != nil {
+			return fmt.Errorf("Error with async: %v\n", err)
+		}
+	}
+
 	_, err = os.Stat(e.Config)
 	if err == nil {
 		content, err := os.ReadFile(e.Config)
@@ -72,35 +115,85 @@ func (e *ExecCmd) Run(ctx *kong.Context) error {
 	// We replace every named file that will be local (such as {/etc/hostname}) with a base file
 	// ({hostname} in this example), and we add the file to the request form.
 	// We also add a suffix .i if the same name appears multiple times
-	replacements := make([][]string, 0)
-	matches := cmdWithFilesRE.FindAllStringSubmatch(e.Command, -1)
-	for _, match := range matches {
-		path := match[1]
-		_, err := os.Stat(path)
-		if err != nil {
-			return fmt.Errorf("Invalid referenced file %s: %v\n", path, err)
-		}
-		basename := filepath.Base(path)
-		name := basename
-		i := 0
-		for {
-			if _, seen := seenFiles[name]; !seen {
-				break
+	sendFiles := func(s string) (string, error) {
+		replacements := make([][]string, 0)
+		matches := cmdWithFilesRE.FindAllStringSubmatch(s, -1)
+		for _, match := range matches {
+			path := match[1]
+			_, err := os.Stat(path)
+			if err != nil {
+				return "", fmt.Errorf("Invalid referenced file %s: %v\n", path, err)
+			}
+			basename := filepath.Base(path)
+			name := basename
+			i := 0
+			for {
+				if _, seen := seenFiles[name]; !seen {
+					break
+				}
+				i += 1
+				name = fmt.Sprintf("%s.%d", basename, i)
 			}
-			i += 1
-			name = fmt.Sprintf("%s.%d", basename, i)
+			seenFiles[name] = struct{}{}
+			writeFileOrDir(mw, name, path)
+			replacements = append(replacements, []string{path, name})
 		}
-		writeFileOrDir(mw, name, path)
-		replacements = append(replacements, []string{path, name})
+
+		for _, replacement := range replacements {
+			s = strings.Replace(s, replacement[0], replacement[1], 1)
+		}
+		return s, nil
 	}
 
-	command := e.Command
-	for _, replacement := range replacements {
-		command = strings.Replace(command, replacement[0], replacement[1], 1)
+	if (e.Command == "") == (e.Template == "") {
+		return fmt.Errorf("Exactly one of --command and --template must be given\n")
 	}
-	err = mw.WriteField("command", command)
-	if err != nil {
-		return fmt.Errorf("Error with command: %v\n", err)
+
+	if e.Command != "" {
+		command, err := sendFiles(e.Command)
+		if err != nil {
+			return err
+		}
+		err = mw.WriteField("command", command)
+		if err != nil {
+			return fmt.Errorf("Error with command: %v\n", err)
+		}
+	}
+
+	if e.Template != "" {
+		err = mw.WriteField("template", e.Template)
+		if err != nil {
+			return fmt.Errorf("Error with template: %v\n", err)
+		}
+	}
+
+	for _, param := range e.Param {
+		param, err := sendFiles(param)
+		if err != nil {
+			return err
+		}
+		err = mw.WriteField("params", param)
+		if err != nil {
+			return fmt.Errorf("Error with params: %v\n", err)
+		}
+	}
+
+	if e.Backend != "" {
+		err = mw.WriteField("backend", e.Backend)
+		if err != nil {
+			return fmt.Errorf("Error with backend: %v\n", err)
+		}
+	}
+
+	for _, arg := range e.Arg {
+		arg, err := sendFiles(arg)
+		if err != nil {
+			return err
+		}
+		err = mw.WriteField("args", arg)
+		if err != nil {
+			return fmt.Errorf("Error with args: %v\n", err)
+		}
 	}
 
 	err = mw.Close()
@@ -113,17 +206,29 @@ func (e *ExecCmd) Run(ctx *kong.Context) error {
 	if e.Id != url.PathEscape(e.Id) {
 		return fmt.Errorf("id has url-unsafe characters, please choose something else")
 	}
-	uu := fmt.Sprintf("http://%s:8079/exec/%s", host, e.Id)
+	uu := fmt.Sprintf("%s://%s:8079/exec/%s", scheme, host, e.Id)
 	u, err := url.Parse(uu)
 	if err != nil {
 		return fmt.Errorf("Invalid parameters for host or id: %v\n", err)
 	}
-	return doRequest(u.String(), mw.Boundary(), b, len(hosts))
+	return doRequest("POST", u.String(), mw.Boundary(), b, len(hosts), e.Fields...)
 
 }
 
-func doRequest(url, boundary string, body bytes.Buffer, numSites int) error {
-	req, err := http.NewRequest("POST", url, &body)
+// doRequest sends the form and prints the given fields of the replies as
+// they arrive, or the default ones if none is given. If the number of sites
+// isn't known, numSites is 0
+func doRequest(method, url, boundary string, body bytes.Buffer, numSites int, fields ...string) error {
+	if len(fields) == 0 {
+		fields = defaultFields
+	}
+	for _, field := range fields {
+		if _, ok := replyFields[field]; !ok {
+			return fmt.Errorf("Unknown field %s\n", field)
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &body)
 	if err != nil {
 		return fmt.Errorf("Error building request for %s: %v\n", url, err)
 	}
@@ -135,16 +240,22 @@ func doRequest(url, boundary string, body bytes.Buffer, numSites int) error {
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusAccepted {
+		// Asynchronous request, the replies are not there yet
+		var accepted struct {
+			RequestId string
+		}
+		err := json.NewDecoder(res.Body).Decode(&accepted)
+		if err != nil {
+			return fmt.Errorf("Invalid reply: %v\n", err)
+		}
+		fmt.Println(accepted.RequestId)
+		return nil
+	}
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("Couldn't run request on %s: %v\n", url, res.Status)
 	}
 
-	type reply struct {
-		Site      string
-		Status    string
-		Output    string
-		RequestId string
-	}
 	sc := bufio.NewScanner(res.Body)
 	counter := 0
 	for sc.Scan() {
@@ -155,12 +266,93 @@ func doRequest(url, boundary string, body bytes.Buffer, numSites int) error {
 			continue
 		}
 		counter++
-		fmt.Printf("[%d/%d] %s %s %s\t%s\n", counter, numSites, r.Status, r.RequestId, r.Site, r.Output)
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			values = append(values, replyFields[field](r))
+		}
+		if numSites > 0 {
+			fmt.Printf("[%d/%d] %s\n", counter, numSites, formatFields(fields, values))
+		} else {
+			fmt.Printf("[%d] %s\n", counter, formatFields(fields, values))
+		}
 	}
 	return sc.Err()
 
 }
 
+// reply is what the cli knows of the replies of cheops
+type reply struct {
+	Site       string
+	Status     string
+	Output     string
+	Stdout     string
+	Stderr     string
+	Truncated  bool
+	RequestId  string
+	ExitCode   int
+	Duration   string
+	ErrorClass string
+	Attempt    int
+	Identity   string
+	Objects    []struct {
+		Kind      string
+		Namespace string
+		Name      string
+		Action    string
+		Rollout   string
+	}
+}
+
+var defaultFields = []string{"status", "request", "site", "output"}
+
+// replyFields are the fields that can be printed, by name
+var replyFields = map[string]func(reply) string{
+	"status":   func(r reply) string { return r.Status },
+	"request":  func(r reply) string { return r.RequestId },
+	"site":     func(r reply) string { return r.Site },
+	"output":   func(r reply) string { return r.Output },
+	"stdout":   func(r reply) string { return r.Stdout },
+	"stderr":   func(r reply) string { return r.Stderr },
+	"exitcode": func(r reply) string { return strconv.Itoa(r.ExitCode) },
+	"duration": func(r reply) string { return r.Duration },
+	"error":    func(r reply) string { return r.ErrorClass },
+	"attempt":  func(r reply) string { return strconv.Itoa(r.Attempt) },
+	"identity": func(r reply) string { return r.Identity },
+	"truncated": func(r reply) string {
+		return strconv.FormatBool(r.Truncated)
+	},
+	"objects": func(r reply) string {
+		objects := make([]string, 0)
+		for _, o := range r.Objects {
+			object := fmt.Sprintf("%s/%s %s", strings.ToLower(o.Kind), o.Name, o.Action)
+			if o.Rollout != "" {
+				object += " (rollout " + o.Rollout + ")"
+			}
+			objects = append(objects, object)
+		}
+		return strings.Join(objects, ",")
+	},
+}
+
+// formatFields separates the fields with spaces, except the outputs that come
+// last after a tab
+func formatFields(fields, values []string) string {
+	var short, long []string
+	for i, field := range fields {
+		switch field {
+		case "output", "stdout", "stderr":
+			long = append(long, values[i])
+		default:
+			short = append(short, values[i])
+		}
+	}
+	ret := strings.Join(short, " ")
+	if len(long) > 0 {
+		ret += "\t" + strings.Join(long, "\t")
+	}
+	return ret
+}
+
 func writeFileOrDir(mw *multipart.Writer, filename, path string) {
 	stat, err := os.Stat(path)
 	if err != nil {
@@ -4,23 +4,51 @@
 // Available commands:
 // - exec
 // - show
+// - delete
+// - relocate
+// - checkpoints
+// - status
+// - cancel
 //
 // See the relevant files for more information
 
 package main
 
 import (
+	"net/http"
+
 	"github.com/alecthomas/kong"
 )
 
 type CLI struct {
-	Exec ExecCmd `cmd:"" help:"Run a command for a given resource"`
-	Show ShowCmd `cmd:"" help:"Show resource listed by id, in all places it is supposed to be"`
+	Token       string `help:"Token to authenticate with on every site" env:"CHEOPS_TOKEN"`
+	Credentials string `help:"File with the tokens to authenticate with, see credentials.go" type:"path" default:"~/.config/cheops/credentials.yml" env:"CHEOPS_CREDENTIALS"`
+	TLS         bool   `help:"Call the sites with https; implied by --ca and --cert" name:"tls" env:"CHEOPS_TLS"`
+	CA          string `help:"PEM file of the CA that signs the certificates of the sites" name:"ca" type:"path" env:"CHEOPS_CA"`
+	Cert        string `help:"PEM file of the client certificate to authenticate with" type:"path" env:"CHEOPS_CERT"`
+	Key         string `help:"PEM file of the key of the client certificate, if it isn't in --cert" type:"path" env:"CHEOPS_KEY"`
+
+	Exec        ExecCmd        `cmd:"" help:"Run a command for a given resource"`
+	Show        ShowCmd        `cmd:"" help:"Show resource listed by id, in all places it is supposed to be"`
+	Delete      DeleteCmd      `cmd:"" help:"Delete a resource everywhere, after running its cleanup command"`
+	Relocate    RelocateCmd    `cmd:"" help:"Change the sites of a resource"`
+	Checkpoints CheckpointsCmd `cmd:"" help:"Show or reset where a site is in the changes feed"`
+	Status      StatusCmd      `cmd:"" help:"Show the replies to a request and the sites that haven't replied"`
+	Cancel      CancelCmd      `cmd:"" help:"Kill the command of a request running on a site"`
 }
 
 func main() {
 	var cli CLI
 	ctx := kong.Parse(&cli, kong.UsageOnError())
-	err := ctx.Run()
+	creds, err := loadCredentials(cli.Credentials, cli.Token)
+	ctx.FatalIfErrorf(err)
+	var next http.RoundTripper = http.DefaultTransport
+	if cli.TLS || cli.CA != "" || cli.Cert != "" {
+		scheme = "https"
+		next, err = tlsTransport(cli.CA, cli.Cert, cli.Key)
+		ctx.FatalIfErrorf(err)
+	}
+	http.DefaultClient.Transport = transport{creds: creds, next: next}
+	err = ctx.Run()
 	ctx.FatalIfErrorf(err)
 }
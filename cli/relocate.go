@@ -0,0 +1,52 @@
+// relocate.go changes the sites where a resource exists. New sites run all the
+// operations of the resource; removed sites run the cleanup command of the
+// resource, unless another command is given.
+//
+// Usage:
+// $ cli relocate --id my-deployment --site S1 --sites "S1&S3" [--command "kubectl delete deployment my-deployment"]
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+
+	"github.com/alecthomas/kong"
+)
+
+type RelocateCmd struct {
+	Id      string `help:"id of the resource" required:""`
+	Site    string `help:"A site where the resource exists" required:""`
+	Sites   string `help:"The new sites of the resource, separated by an &" required:""`
+	Command string `help:"Teardown command to run on removed sites instead of the cleanup in the resource config"`
+}
+
+func (r *RelocateCmd) Run(ctx *kong.Context) error {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	err := mw.WriteField("sites", r.Sites)
+	if err != nil {
+		return fmt.Errorf("Error with sites: %v\n", err)
+	}
+	if r.Command != "" {
+		err := mw.WriteField("command", r.Command)
+		if err != nil {
+			return fmt.Errorf("Error with command: %v\n", err)
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return fmt.Errorf("Error with form: %v\n", err)
+	}
+
+	if r.Id != url.PathEscape(r.Id) {
+		return fmt.Errorf("id has url-unsafe characters, please choose something else")
+	}
+	u, err := url.Parse(fmt.Sprintf("%s://%s:8079/relocate/%s", scheme, r.Site, r.Id))
+	if err != nil {
+		return fmt.Errorf("Invalid parameters for site or id: %v\n", err)
+	}
+	return doRequest("POST", u.String(), mw.Boundary(), b, 0)
+}
@@ -6,7 +6,7 @@
 // the id that is given.
 //
 // Usage:
-// $ cli show --id <resource-id> --from siteX --command <command>
+// $ cli show --id <resource-id> --from siteX --command <command> [--timeout 1m]
 //
 // Output:
 //
@@ -32,22 +32,27 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
 
 type ShowCmd struct {
-	Id      string `help:"Id of resource, must not be empty" required:""`
-	From    string `help:"The site from which to query other sites" required:""`
-	Command string `help:"Command to run" required:"" short:""`
+	Id      string        `help:"Id of resource, must not be empty" required:""`
+	From    string        `help:"The site from which to query other sites" required:""`
+	Command string        `help:"Command to run" required:"" short:""`
+	Timeout time.Duration `help:"How long to wait for the outputs of all sites, instead of the default of the node"`
 }
 
 func (s *ShowCmd) Run(ctx *kong.Context) error {
-	u := fmt.Sprintf("http://%s:8079/show/%s", s.From, s.Id)
+	u := fmt.Sprintf("%s://%s:8079/show/%s", scheme, s.From, s.Id)
 
 	var b bytes.Buffer
 	mw := multipart.NewWriter(&b)
 	mw.WriteField("command", s.Command)
+	if s.Timeout > 0 {
+		mw.WriteField("timeout", s.Timeout.String())
+	}
 	mw.Close()
 
 	req, err := http.NewRequestWithContext(context.Background(), "POST", u, &b)
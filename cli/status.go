@@ -0,0 +1,63 @@
+// status.go shows the replies to a request, as known by a site, and the sites
+// that haven't replied yet. It is mostly useful after `cli exec --async`, or
+// when exec stopped waiting before every site replied.
+//
+// Usage:
+// $ cli status <request-id> --site S1
+//
+// Output:
+//
+// OK	S1	<output>
+// KO	S2	<output>
+// PENDING	S3
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alecthomas/kong"
+)
+
+type StatusCmd struct {
+	RequestId string `arg:"" help:"The id of the request"`
+	Site      string `help:"The site to ask" required:""`
+}
+
+func (s *StatusCmd) Run(ctx *kong.Context) error {
+	u := fmt.Sprintf("%s://%s:8079/requests/%s", scheme, s.Site, url.PathEscape(s.RequestId))
+	res, err := http.Get(u)
+	if err != nil {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("Request %s is unknown on %s\n", s.RequestId, s.Site)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Couldn't run request on %s: %v\n", u, res.Status)
+	}
+
+	var status struct {
+		Replies []struct {
+			Site   string
+			Status string
+			Output string
+		}
+		Pending []string
+	}
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return fmt.Errorf("Invalid reply: %v\n", err)
+	}
+	for _, reply := range status.Replies {
+		fmt.Printf("%s\t%s\t%s\n", reply.Status, reply.Site, reply.Output)
+	}
+	for _, site := range status.Pending {
+		fmt.Printf("PENDING\t%s\n", site)
+	}
+	return nil
+}
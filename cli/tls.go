@@ -0,0 +1,49 @@
+// tls.go makes the cli call the sites with https, when they serve it. The
+// sites are checked against --ca, or the roots of the system, and --cert is
+// the client certificate to authenticate with.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// scheme is the one of the API of the sites
+var scheme = "http"
+
+// tlsTransport returns a transport that uses https with the given CA and
+// client certificate, which can be empty. The key is read from the
+// certificate file if it isn't given
+func tlsTransport(ca, cert, key string) (*http.Transport, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if ca != "" {
+		content, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("No certificate in CA %s", ca)
+		}
+	}
+	if cert != "" {
+		if key == "" {
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load the client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return transport, nil
+}
@@ -0,0 +1,793 @@
+// Package config loads the configuration of a Cheops node.
+//
+// The configuration is read from a yaml file (config.yml by default, or
+// whatever the CHEOPS_CONFIG environment variable points to). Every value can
+// then be overridden with an environment variable named after its path in
+// upper case, such as CHEOPS_DATABASE_PASSWORD or CHEOPS_LOCALSITE_NAME.
+// Elements of lists are designated by their name, for example
+// CHEOPS_LOCALSERVICES_API_PORT.
+package config
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Application Application `yaml:"application"`
+	Database    Database    `yaml:"database"`
+
+	// The site this node runs on
+	LocalSite LocalSite `yaml:"localsite"`
+
+	// Other sites, when they can't be reached with their name only
+	KnownSites []Site `yaml:"knownsites"`
+
+	// The endpoints this node listens on
+	LocalServices []Service `yaml:"localservices"`
+
+	// Garbage collection of the database
+	Compaction Compaction `yaml:"compaction"`
+
+	// How operations are run
+	Execution Execution `yaml:"execution"`
+
+	// How long requests wait for replies
+	Requests Requests `yaml:"requests"`
+
+	// How the kubernetes backend reaches its cluster
+	Kubernetes Kubernetes `yaml:"kubernetes"`
+
+	// What callers can run
+	Operations Operations `yaml:"operations"`
+
+	// Who can use the API
+	Auth Auth `yaml:"auth"`
+
+	// The certificate of the node, for the listeners and the calls to the
+	// other sites
+	TLS TLS `yaml:"tls"`
+}
+
+type Application struct {
+	Name string `yaml:"name"`
+}
+
+// Database describes how to reach the local CouchDB
+type Database struct {
+	// Url of the CouchDB server, without the database
+	URL string `yaml:"url"`
+
+	// Name of the database
+	Name string `yaml:"dbname"`
+
+	// Admin credentials
+	User     string `yaml:"dbuser"`
+	Password string `yaml:"dbpassword"`
+
+	// How CouchDB reaches the other sites to replicate
+	Replication Replication `yaml:"replication"`
+}
+
+// Replication describes how CouchDB replicates to the other sites. Without
+// TLS, it uses the scheme and the port of the url of the local server
+type Replication struct {
+	// Replicate to https://<site>:<port>
+	TLS  bool `yaml:"tls"`
+	Port int  `yaml:"port"`
+
+	// Paths on the CouchDB server: the CA that signs the certificates of
+	// the other sites, and the certificate and key CouchDB authenticates
+	// with on them
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type LocalSite struct {
+	// The name of this site, as used in the locations of resources. It
+	// must be resolvable by other sites.
+	Name string `yaml:"name"`
+}
+
+// Site is a remote site
+type Site struct {
+	// The name of the site, as used in the locations of resources
+	Name string `yaml:"name"`
+
+	// The address of the API of the site, as host:port
+	Address string `yaml:"address"`
+}
+
+// Compaction describes how often garbage is removed from the database
+type Compaction struct {
+	// Time between two compactions. 0 disables them
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Execution describes how operations are run
+type Execution struct {
+	// How many resources can have their operations run at the same time.
+	// Operations of the same resource always run one after the other
+	Workers int `yaml:"workers"`
+
+	// Maximum size in bytes of stdout and stderr kept in replies; longer
+	// outputs are cut. 0 keeps everything
+	OutputLimit int `yaml:"outputlimit"`
+
+	// What commands run by the shell and exec backends can do
+	Sandbox Sandbox `yaml:"sandbox"`
+}
+
+// Sandbox restricts the processes of commands. Without it, they have the
+// rights of cheops
+type Sandbox struct {
+	Enabled bool `yaml:"enabled"`
+
+	// User and group the commands run as; 0 keeps those of cheops
+	UID int `yaml:"uid"`
+	GID int `yaml:"gid"`
+
+	// Run commands in bubblewrap (bwrap), with a read-only root where only
+	// the working directory of the command is writable
+	ReadOnlyRoot bool `yaml:"readonlyroot"`
+
+	// Namespaces the commands get for themselves, among user, pid, net,
+	// ipc, uts and mount
+	Namespaces []string `yaml:"namespaces"`
+
+	// File with a compiled seccomp filter for the commands, as bwrap takes
+	// it. Commands are run in bubblewrap if it is given
+	Seccomp string `yaml:"seccomp"`
+
+	// Limits of the commands: CPU time, virtual memory and size of the
+	// files they write, in bytes. 0 is no limit
+	CPUTime  time.Duration `yaml:"cputime"`
+	Memory   int64         `yaml:"memory"`
+	FileSize int64         `yaml:"filesize"`
+
+	// Names of the environment variables of cheops that commands get
+	Environment []string `yaml:"environment"`
+}
+
+// SandboxNamespaces are the namespaces a sandbox can have
+var SandboxNamespaces = []string{"user", "pid", "net", "ipc", "uts", "mount"}
+
+// Requests describes how long the API waits for the replies of other sites
+// before answering TIMEOUT for them. Operations still run in the background
+type Requests struct {
+	// Used when the request doesn't give any timeout
+	Timeout time.Duration `yaml:"timeout"`
+
+	// The longest timeout a request can ask for
+	MaxTimeout time.Duration `yaml:"maxtimeout"`
+}
+
+// Kubernetes describes how the kubernetes backend reaches the API server.
+// If Server is empty and the node runs in a pod, the service account of the
+// pod is used; otherwise the backend is disabled
+type Kubernetes struct {
+	// Url of the API server, such as https://10.0.0.1:6443
+	Server string `yaml:"server"`
+
+	// Bearer token, or a file to read it from
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenfile"`
+
+	// PEM file of the CA of the API server; the system CAs are used if
+	// empty
+	CA string `yaml:"ca"`
+
+	// Don't check the certificate of the API server
+	Insecure bool `yaml:"insecure"`
+
+	// Namespace of the objects that don't give one
+	Namespace string `yaml:"namespace"`
+}
+
+// Operations describes what callers can run on this node
+type Operations struct {
+	// Accept any command. Otherwise, only the templates can be run
+	Permissive bool `yaml:"permissive"`
+
+	Templates []Template `yaml:"templates"`
+}
+
+// Template is an operation callers can run by name. In its command and
+// arguments, every {{param}} is replaced with the value of the parameter
+type Template struct {
+	Name string `yaml:"name"`
+
+	// The backend that runs the command, shell if empty
+	Backend string   `yaml:"backend"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+
+	Parameters []Parameter `yaml:"parameters"`
+}
+
+// Parameter is a value given by the caller of a template
+type Parameter struct {
+	Name string `yaml:"name"`
+
+	// One of the Parameter* types, ParameterString if empty
+	Type string `yaml:"type"`
+
+	// For strings, a regular expression the whole value must match
+	Pattern string `yaml:"pattern"`
+
+	// The values allowed; any if empty
+	Values []string `yaml:"values"`
+
+	// Without it, the default is used when the caller doesn't give the
+	// parameter
+	Required bool   `yaml:"required"`
+	Default  string `yaml:"default"`
+}
+
+// Types of parameters
+const (
+	ParameterString = "string"
+	ParameterInt    = "int"
+	ParameterBool   = "bool"
+
+	// The name of a file sent with the request
+	ParameterFile = "file"
+)
+
+// Template returns the template with the given name
+func (o Operations) Template(name string) (Template, bool) {
+	for _, t := range o.Templates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Template{}, false
+}
+
+var templateParamRE = regexp.MustCompile(`{{([^{}]*)}}`)
+
+// Placeholders returns the names of the parameters used in s
+func Placeholders(s string) []string {
+	names := make([]string, 0)
+	for _, match := range templateParamRE.FindAllStringSubmatch(s, -1) {
+		names = append(names, strings.TrimSpace(match[1]))
+	}
+	return names
+}
+
+// ReplacePlaceholders replaces every {{param}} in s with what value returns
+// for the parameter
+func ReplacePlaceholders(s string, value func(name string) string) string {
+	return templateParamRE.ReplaceAllStringFunc(s, func(match string) string {
+		return value(strings.TrimSpace(match[2 : len(match)-2]))
+	})
+}
+
+// validate checks that the template is usable
+func (t Template) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("Templates must have a name")
+	}
+	if t.Command == "" {
+		return fmt.Errorf("Template %s has no command", t.Name)
+	}
+
+	params := make(map[string]struct{})
+	for _, p := range t.Parameters {
+		if p.Name == "" {
+			return fmt.Errorf("Parameters of template %s must have a name", t.Name)
+		}
+		if _, ok := params[p.Name]; ok {
+			return fmt.Errorf("Parameter %s of template %s is defined multiple times", p.Name, t.Name)
+		}
+		params[p.Name] = struct{}{}
+
+		switch p.Type {
+		case "", ParameterString, ParameterInt, ParameterBool, ParameterFile:
+		default:
+			return fmt.Errorf("Unknown type %q for parameter %s of template %s", p.Type, p.Name, t.Name)
+		}
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("Invalid pattern for parameter %s of template %s: %v", p.Name, t.Name, err)
+		}
+	}
+
+	for _, s := range append([]string{t.Command}, t.Args...) {
+		for _, name := range Placeholders(s) {
+			if _, ok := params[name]; !ok {
+				return fmt.Errorf("Template %s uses the unknown parameter %q", t.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Auth describes who can use the API. Callers give the token of their user
+// as "Authorization: Bearer <token>", and can do what one of the rules
+// allows them to
+type Auth struct {
+	Enabled bool `yaml:"enabled"`
+
+	Users []User `yaml:"users"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// User is a caller of the API. A user without a token can only
+// authenticate with a client certificate whose common name is its name
+type User struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// Rule allows users to do actions on resources
+type Rule struct {
+	// Resources whose id starts with the prefix; an empty prefix is for
+	// all resources, and for the actions that are not on a resource
+	Prefix string `yaml:"prefix"`
+
+	// Names of the users; "*" is every user
+	Users []string `yaml:"users"`
+
+	// Among the Action* actions
+	Actions []string `yaml:"actions"`
+
+	// Sites the actions can target; any if empty. Actions whose sites are
+	// not known, such as deletions, are only allowed by rules without
+	// sites
+	Sites []string `yaml:"sites"`
+}
+
+// Actions of the API
+const (
+	ActionExec     = "exec"
+	ActionShow     = "show"
+	ActionDelete   = "delete"
+	ActionRelocate = "relocate"
+	ActionCancel   = "cancel"
+
+	// Managing the node itself, such as its checkpoints
+	ActionAdmin = "admin"
+)
+
+var actions = []string{ActionExec, ActionShow, ActionDelete, ActionRelocate, ActionCancel, ActionAdmin}
+
+// User returns the name of the user with the token
+func (a Auth) User(token string) (string, bool) {
+	for _, u := range a.Users {
+		if token != "" && subtle.ConstantTimeCompare([]byte(u.Token), []byte(token)) == 1 {
+			return u.Name, true
+		}
+	}
+	return "", false
+}
+
+// Allows returns true if a rule allows the user to do the action on the
+// resource, at the given sites. sites is nil or empty if they are not known
+func (a Auth) Allows(user, action, resourceId string, sites []string) bool {
+	for _, rule := range a.Rules {
+		if !strings.HasPrefix(resourceId, rule.Prefix) || !contains(rule.Actions, action) {
+			continue
+		}
+		if !contains(rule.Users, user) && !contains(rule.Users, "*") {
+			continue
+		}
+		if len(rule.Sites) > 0 {
+			if len(sites) == 0 {
+				continue
+			}
+			allowed := true
+			for _, site := range sites {
+				allowed = allowed && contains(rule.Sites, site)
+			}
+			if !allowed {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// AllowsSomewhere returns true if a rule allows the user to do the action on
+// some resources, at some sites
+func (a Auth) AllowsSomewhere(user, action string) bool {
+	for _, rule := range a.Rules {
+		if contains(rule.Actions, action) && (contains(rule.Users, user) || contains(rule.Users, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TLS makes every listener of the node serve https, and the node call the
+// API of the other sites with https
+type TLS struct {
+	// PEM files of the certificate of the node and of its key. TLS is
+	// enabled when they are given
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// PEM file of the CA that signs the certificates of the other sites
+	// and of the clients; the roots of the system if empty
+	CA string `yaml:"ca"`
+
+	// Refuse the clients without a certificate signed by the CA. Otherwise
+	// their certificate is only checked if they give one
+	ClientAuth bool `yaml:"clientauth"`
+}
+
+// Service is an endpoint this node listens on
+type Service struct {
+	// One of "api", "chephren" or "dump"
+	Name string `yaml:"name"`
+
+	// Address to listen on. Empty means all interfaces
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+}
+
+func (s Service) ListenAddress() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+const (
+	ServiceAPI      = "api"
+	ServiceChephren = "chephren"
+	ServiceDump     = "dump"
+)
+
+// Default returns the configuration used when nothing is specified
+func Default() Config {
+	return Config{
+		Database: Database{
+			URL:  "http://localhost:5984",
+			Name: "cheops",
+			User: "admin",
+			Replication: Replication{
+				Port: 6984,
+			},
+		},
+		LocalServices: []Service{
+			{Name: ServiceAPI, Port: 8079},
+			{Name: ServiceChephren, Port: 8080},
+			{Name: ServiceDump, Port: 7071},
+		},
+		Compaction: Compaction{
+			Interval: time.Hour,
+		},
+		Execution: Execution{
+			Workers:     4,
+			OutputLimit: 64 * 1024,
+			Sandbox: Sandbox{
+				Environment: []string{"PATH", "LANG"},
+			},
+		},
+		Requests: Requests{
+			Timeout:    30 * time.Second,
+			MaxTimeout: 10 * time.Minute,
+		},
+		Kubernetes: Kubernetes{
+			Namespace: "default",
+		},
+		Operations: Operations{
+			Permissive: true,
+		},
+	}
+}
+
+// Path returns the path of the configuration file
+func Path() string {
+	if p, ok := os.LookupEnv("CHEOPS_CONFIG"); ok {
+		return p
+	}
+	return "config.yml"
+}
+
+// Load reads the configuration at the given path, applies environment
+// overrides and validates the result. A missing file is not an error: the
+// defaults are used.
+func Load(path string) (Config, error) {
+	c := Default()
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return c, fmt.Errorf("Couldn't read %s: %v", path, err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal(content, &c)
+		if err != nil {
+			return c, fmt.Errorf("Invalid configuration in %s: %v", path, err)
+		}
+	}
+	c.addDefaultServices()
+
+	// Historical way of giving the site name
+	if fqdn, ok := os.LookupEnv("MYFQDN"); ok {
+		c.LocalSite.Name = fqdn
+	}
+
+	err = applyEnv("CHEOPS", reflect.ValueOf(&c).Elem())
+	if err != nil {
+		return c, err
+	}
+
+	return c, c.Validate()
+}
+
+// addDefaultServices adds the services that are not in the file
+func (c *Config) addDefaultServices() {
+	for _, def := range Default().LocalServices {
+		found := false
+		for _, s := range c.LocalServices {
+			if s.Name == def.Name {
+				found = true
+			}
+		}
+		if !found {
+			c.LocalServices = append(c.LocalServices, def)
+		}
+	}
+}
+
+// applyEnv overrides the fields of v with the environment variables named
+// after prefix and the field names
+func applyEnv(prefix string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := prefix + "_" + strings.ToUpper(v.Type().Field(i).Name)
+			err := applyEnv(name, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				elem := v.Index(i)
+				name := elem.FieldByName("Name")
+				if !name.IsValid() {
+					continue
+				}
+				err := applyEnv(prefix+"_"+strings.ToUpper(name.String()), elem)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	value, ok := os.LookupEnv(prefix)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid duration in %s: %v", prefix, err)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid number in %s: %v", prefix, err)
+		}
+		v.SetInt(i)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid boolean in %s: %v", prefix, err)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		parts := make([]string, 0)
+		for _, part := range strings.Split(value, ",") {
+			if p := strings.TrimSpace(part); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("%s can't be set from the environment", prefix)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.LocalSite.Name == "" {
+		return fmt.Errorf("The site name must be given in localsite.name or with the CHEOPS_LOCALSITE_NAME environment variable")
+	}
+
+	u, err := url.Parse(c.Database.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid database url: %q", c.Database.URL)
+	}
+	if c.Database.Name == "" {
+		return fmt.Errorf("The database name can't be empty")
+	}
+	replication := c.Database.Replication
+	if replication.Port < 1 || replication.Port > 65535 {
+		return fmt.Errorf("Invalid replication port: %d", replication.Port)
+	}
+	if (replication.Cert == "") != (replication.Key == "") {
+		return fmt.Errorf("database.replication.cert and database.replication.key go together")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key go together")
+	}
+	if c.TLS.ClientAuth && (c.TLS.Cert == "" || c.TLS.CA == "") {
+		return fmt.Errorf("tls.clientauth needs the certificate of the node and a CA")
+	}
+
+	if c.Compaction.Interval < 0 {
+		return fmt.Errorf("Invalid compaction interval: %v", c.Compaction.Interval)
+	}
+
+	if c.Execution.Workers < 1 {
+		return fmt.Errorf("Invalid number of workers: %d", c.Execution.Workers)
+	}
+	if c.Execution.OutputLimit < 0 {
+		return fmt.Errorf("Invalid output limit: %d", c.Execution.OutputLimit)
+	}
+
+	sandbox := c.Execution.Sandbox
+	if sandbox.UID < 0 || sandbox.GID < 0 {
+		return fmt.Errorf("Invalid sandbox user: %d:%d", sandbox.UID, sandbox.GID)
+	}
+	if sandbox.CPUTime < 0 || sandbox.Memory < 0 || sandbox.FileSize < 0 {
+		return fmt.Errorf("Sandbox limits can't be negative")
+	}
+	for _, namespace := range sandbox.Namespaces {
+		known := false
+		for _, n := range SandboxNamespaces {
+			known = known || n == namespace
+		}
+		if !known {
+			return fmt.Errorf("Unknown sandbox namespace %q, expected one of %s", namespace, strings.Join(SandboxNamespaces, ", "))
+		}
+	}
+
+	if c.Requests.Timeout <= 0 {
+		return fmt.Errorf("Invalid request timeout: %v", c.Requests.Timeout)
+	}
+	if c.Requests.MaxTimeout < c.Requests.Timeout {
+		return fmt.Errorf("The maximum request timeout (%v) can't be less than the default one (%v)", c.Requests.MaxTimeout, c.Requests.Timeout)
+	}
+
+	if c.Kubernetes.Server != "" {
+		u, err := url.Parse(c.Kubernetes.Server)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid kubernetes server: %q", c.Kubernetes.Server)
+		}
+	}
+	if c.Kubernetes.Token != "" && c.Kubernetes.TokenFile != "" {
+		return fmt.Errorf("Only one of kubernetes.token and kubernetes.tokenfile can be given")
+	}
+
+	users := make(map[string]struct{})
+	tokens := make(map[string]struct{})
+	for _, u := range c.Auth.Users {
+		if u.Name == "" {
+			return fmt.Errorf("Users must have a name")
+		}
+		if _, ok := users[u.Name]; ok {
+			return fmt.Errorf("User %s is defined multiple times", u.Name)
+		}
+		users[u.Name] = struct{}{}
+		if _, ok := tokens[u.Token]; ok && u.Token != "" {
+			return fmt.Errorf("User %s has the token of another user", u.Name)
+		}
+		tokens[u.Token] = struct{}{}
+	}
+	for _, rule := range c.Auth.Rules {
+		for _, action := range rule.Actions {
+			if !contains(actions, action) {
+				return fmt.Errorf("Unknown action %q, expected one of %s", action, strings.Join(actions, ", "))
+			}
+		}
+		for _, user := range rule.Users {
+			if _, ok := users[user]; !ok && user != "*" {
+				return fmt.Errorf("Rule for prefix %q has the unknown user %s", rule.Prefix, user)
+			}
+		}
+	}
+	if c.Auth.Enabled && len(c.Auth.Users) == 0 {
+		return fmt.Errorf("Authentication is enabled without users")
+	}
+
+	templates := make(map[string]struct{})
+	for _, t := range c.Operations.Templates {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if _, ok := templates[t.Name]; ok {
+			return fmt.Errorf("Template %s is defined multiple times", t.Name)
+		}
+		templates[t.Name] = struct{}{}
+	}
+
+	names := make(map[string]struct{})
+	addresses := make(map[string]struct{})
+	for _, s := range c.LocalServices {
+		switch s.Name {
+		case ServiceAPI, ServiceChephren, ServiceDump:
+		default:
+			return fmt.Errorf("Unknown service %q", s.Name)
+		}
+		if _, ok := names[s.Name]; ok {
+			return fmt.Errorf("Service %s is defined multiple times", s.Name)
+		}
+		names[s.Name] = struct{}{}
+
+		if s.Port <= 0 || s.Port > 65535 {
+			return fmt.Errorf("Invalid port for service %s: %d", s.Name, s.Port)
+		}
+		if _, ok := addresses[s.ListenAddress()]; ok {
+			return fmt.Errorf("Service %s listens on an address that is already used: %s", s.Name, s.ListenAddress())
+		}
+		addresses[s.ListenAddress()] = struct{}{}
+	}
+
+	for _, s := range c.KnownSites {
+		if s.Name == "" {
+			return fmt.Errorf("Known sites must have a name")
+		}
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return fmt.Errorf("Invalid address for site %s: %v", s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Service returns the configuration of the given local service
+func (c Config) Service(name string) Service {
+	for _, s := range c.LocalServices {
+		if s.Name == name {
+			return s
+		}
+	}
+	return Service{Name: name}
+}
+
+// SiteAddress returns the host:port of the API of the given site. Sites that
+// are not explicitly known are expected to expose the API on the same port as
+// the local one.
+func (c Config) SiteAddress(site string) string {
+	for _, s := range c.KnownSites {
+		if s.Name == site {
+			return s.Address
+		}
+	}
+	return net.JoinHostPort(site, strconv.Itoa(c.Service(ServiceAPI).Port))
+}
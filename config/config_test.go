@@ -0,0 +1,201 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestLoadDatabase(t *testing.T) {
+	path := writeConfig(t, `
+database:
+  url: "http://127.0.0.1:5985"
+  dbname: "other"
+  dbuser: "cheops"
+  dbpassword: "from-file"
+localsite:
+  name: "site1"
+`)
+	setenv(t, "CHEOPS_DATABASE_PASSWORD", "from-env")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Couldn't load: %v", err)
+	}
+
+	expected := Database{
+		URL:      "http://127.0.0.1:5985",
+		Name:     "other",
+		User:     "cheops",
+		Password: "from-env",
+		Replication: Replication{
+			Port: 6984,
+		},
+	}
+	if c.Database != expected {
+		t.Fatalf("Invalid database config: got %#v want %#v", c.Database, expected)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	setenv(t, "CHEOPS_LOCALSITE_NAME", "site1")
+
+	c, err := Load(filepath.Join(t.TempDir(), "nothing.yml"))
+	if err != nil {
+		t.Fatalf("Missing file should use defaults, got %v", err)
+	}
+	if c.Database != Default().Database {
+		t.Fatalf("Expected defaults, got %#v", c.Database)
+	}
+	if c.Service(ServiceAPI).Port != 8079 {
+		t.Fatalf("Expected default api port, got %d", c.Service(ServiceAPI).Port)
+	}
+}
+
+func TestLoadServices(t *testing.T) {
+	path := writeConfig(t, `
+localsite:
+  name: "site1"
+knownsites:
+  - name: "site2"
+    address: "10.0.0.2:9000"
+localservices:
+  - name: "api"
+    address: "127.0.0.1"
+    port: 9079
+`)
+	setenv(t, "CHEOPS_LOCALSERVICES_API_PORT", "9179")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Couldn't load: %v", err)
+	}
+
+	if addr := c.Service(ServiceAPI).ListenAddress(); addr != "127.0.0.1:9179" {
+		t.Fatalf("Invalid api address: %s", addr)
+	}
+	if c.Service(ServiceChephren).Port != 8080 {
+		t.Fatalf("Missing services should get their default, got %#v", c.Service(ServiceChephren))
+	}
+	if addr := c.SiteAddress("site2"); addr != "10.0.0.2:9000" {
+		t.Fatalf("Invalid address for known site: %s", addr)
+	}
+	if addr := c.SiteAddress("site3"); addr != "site3:9179" {
+		t.Fatalf("Invalid address for unknown site: %s", addr)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	vectors := []struct {
+		content string
+		env     map[string]string
+	}{
+		{content: ``},
+		{content: "localsite:\n  name: site1\ndatabase:\n  url: \"localhost\"\n"},
+		{content: "localsite:\n  name: site1\nlocalservices:\n  - name: api\n    port: 70000\n"},
+		{content: "localsite:\n  name: site1\nlocalservices:\n  - name: api\n    port: 8080\n"},
+		{content: "localsite:\n  name: site1\nlocalservices:\n  - name: other\n    port: 9000\n"},
+		{content: "localsite:\n  name: site1\n", env: map[string]string{"CHEOPS_LOCALSERVICES_DUMP_PORT": "abc"}},
+		{content: "localsite:\n  name: site1\ncompaction:\n  interval: \"-1m\"\n"},
+		{content: "localsite:\n  name: site1\n", env: map[string]string{"CHEOPS_EXECUTION_WORKERS": "0"}},
+		{content: "localsite:\n  name: site1\n", env: map[string]string{"CHEOPS_EXECUTION_OUTPUTLIMIT": "-1"}},
+		{content: "localsite:\n  name: site1\nrequests:\n  timeout: \"0s\"\n"},
+		{content: "localsite:\n  name: site1\nrequests:\n  timeout: \"1m\"\n  maxtimeout: \"30s\"\n"},
+		{content: "localsite:\n  name: site1\nkubernetes:\n  server: \"10.0.0.1:6443\"\n"},
+		{content: "localsite:\n  name: site1\nkubernetes:\n  token: abc\n  tokenfile: /token\n"},
+		{content: "localsite:\n  name: site1\nexecution:\n  sandbox:\n    namespaces: [net, cgroup]\n"},
+		{content: "localsite:\n  name: site1\n", env: map[string]string{"CHEOPS_EXECUTION_SANDBOX_MEMORY": "-1"}},
+		{content: "localsite:\n  name: site1\noperations:\n  templates:\n    - name: scale\n      command: \"kubectl scale --replicas {{replicas}}\"\n"},
+		{content: "localsite:\n  name: site1\noperations:\n  templates:\n    - name: scale\n      command: \"echo {{n}}\"\n      parameters:\n        - name: n\n          type: float\n"},
+		{content: "localsite:\n  name: site1\noperations:\n  templates:\n    - name: a\n      command: \"true\"\n    - name: a\n      command: \"false\"\n"},
+		{content: "localsite:\n  name: site1\nauth:\n  enabled: true\n"},
+		{content: "localsite:\n  name: site1\nauth:\n  users:\n    - name: alice\n      token: a\n    - name: alice\n      token: b\n"},
+		{content: "localsite:\n  name: site1\nauth:\n  users:\n    - name: alice\n      token: a\n    - name: bob\n      token: a\n"},
+		{content: "localsite:\n  name: site1\ntls:\n  cert: /site1.pem\n"},
+		{content: "localsite:\n  name: site1\ntls:\n  cert: /site1.pem\n  key: /site1.key\n  clientauth: true\n"},
+		{content: "localsite:\n  name: site1\n", env: map[string]string{"CHEOPS_DATABASE_REPLICATION_PORT": "0"}},
+		{content: "localsite:\n  name: site1\ndatabase:\n  replication:\n    tls: true\n    key: /couchdb.key\n"},
+		{content: "localsite:\n  name: site1\nauth:\n  users:\n    - name: alice\n      token: a\n  rules:\n    - users: [alice]\n      actions: [run]\n"},
+		{content: "localsite:\n  name: site1\nauth:\n  users:\n    - name: alice\n      token: a\n  rules:\n    - users: [bob]\n      actions: [exec]\n"},
+	}
+
+	for i, v := range vectors {
+		for key, value := range v.env {
+			setenv(t, key, value)
+		}
+		_, err := Load(writeConfig(t, v.content))
+		if err == nil {
+			t.Fatalf("vector %d: expected an error", i)
+		}
+		for key := range v.env {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestAuthAllows(t *testing.T) {
+	auth := Auth{
+		Enabled: true,
+		Users:   []User{{Name: "alice", Token: "a"}, {Name: "bob", Token: "b"}},
+		Rules: []Rule{
+			{Prefix: "", Users: []string{"alice"}, Actions: []string{ActionExec, ActionShow, ActionAdmin}},
+			{Prefix: "front-", Users: []string{"bob"}, Actions: []string{ActionExec}, Sites: []string{"site1", "site2"}},
+			{Prefix: "front-", Users: []string{"*"}, Actions: []string{ActionShow}},
+		},
+	}
+
+	if name, ok := auth.User("b"); !ok || name != "bob" {
+		t.Fatalf("Expected bob, got %q", name)
+	}
+	if _, ok := auth.User(""); ok {
+		t.Fatalf("Expected no user for an empty token")
+	}
+
+	vectors := []struct {
+		user, action, id string
+		sites            []string
+		allowed          bool
+	}{
+		{"alice", ActionExec, "back-1", []string{"site3"}, true},
+		{"alice", ActionAdmin, "", nil, true},
+		{"alice", ActionDelete, "back-1", nil, false},
+		{"bob", ActionExec, "front-1", []string{"site1", "site2"}, true},
+		{"bob", ActionExec, "front-1", []string{"site1", "site3"}, false},
+		{"bob", ActionExec, "front-1", nil, false},
+		{"bob", ActionExec, "front-1", []string{}, false},
+		{"bob", ActionExec, "back-1", []string{"site1"}, false},
+		{"bob", ActionShow, "front-1", []string{"site3"}, true},
+		{"carol", ActionShow, "front-1", nil, true},
+		{"bob", ActionAdmin, "", nil, false},
+	}
+	for i, v := range vectors {
+		if allowed := auth.Allows(v.user, v.action, v.id, v.sites); allowed != v.allowed {
+			t.Fatalf("vector %d: expected %v, got %v", i, v.allowed, allowed)
+		}
+	}
+
+	if !auth.AllowsSomewhere("bob", ActionExec) || auth.AllowsSomewhere("bob", ActionAdmin) || !auth.AllowsSomewhere("carol", ActionShow) {
+		t.Fatalf("Expected bob to exec somewhere and not to be an admin, and everyone to show somewhere")
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Enabled returns true if the node has a certificate
+func (t TLS) Enabled() bool {
+	return t.Cert != ""
+}
+
+// ServerConfig returns the TLS configuration of the listeners
+func (t TLS) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load the certificate of the node: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		cfg.ClientCAs, err = loadCA(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.ClientAuth {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// ClientConfig returns the TLS configuration of the calls to the other
+// sites. The node authenticates with its certificate, if it has one
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load the certificate of the node: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.CA != "" {
+		pool, err := loadCA(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("No certificate in CA %s", path)
+	}
+	return pool, nil
+}
+
+// Scheme returns the scheme of the API of the sites
+func (c Config) Scheme() string {
+	if c.TLS.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// Client returns a client for the API of the other sites
+func (c Config) Client() (*http.Client, error) {
+	if !c.TLS.Enabled() && c.TLS.CA == "" {
+		return http.DefaultClient, nil
+	}
+	tlsConfig, err := c.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// ListenAndServe serves h on the address of the local service, with https if
+// the node has a certificate
+func (c Config) ListenAndServe(service string, h http.Handler) error {
+	server := &http.Server{
+		Addr:    c.Service(service).ListenAddress(),
+		Handler: h,
+	}
+	if !c.TLS.Enabled() {
+		return server.ListenAndServe()
+	}
+	tlsConfig, err := c.TLS.ServerConfig()
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA generates certificates signed by a CA of its own
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	Path string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key, ca.Path = ca.issue("ca", true)
+	return ca
+}
+
+// Issue returns the paths of a new certificate for the name, valid for the
+// local addresses, and of its key
+func (ca *testCA) Issue(name string) (cert, key string) {
+	_, k, cert := ca.issue(name, false)
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	key = filepath.Join(ca.dir, name+".key")
+	ca.write(key, "EC PRIVATE KEY", der)
+	return cert, key
+}
+
+func (ca *testCA) issue(name string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	path := filepath.Join(ca.dir, name+".pem")
+	ca.write(path, "CERTIFICATE", der)
+	return cert, key, path
+}
+
+func (ca *testCA) write(path, typ string, der []byte) {
+	content := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+// serveTLS starts a server with the TLS of the node, that replies with the
+// common name of the client certificate
+func serveTLS(t *testing.T, node TLS) *httptest.Server {
+	tlsConfig, err := node.ServerConfig()
+	if err != nil {
+		t.Fatalf("Couldn't get server config: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			fmt.Fprint(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}))
+	server.TLS = tlsConfig
+	// Refused handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call returns what the server replied to the client of the node
+func call(t *testing.T, node TLS, u string) (string, error) {
+	client, err := Config{TLS: node}.Client()
+	if err != nil {
+		t.Fatalf("Couldn't get client: %v", err)
+	}
+	res, err := client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var b [64]byte
+	n, _ := res.Body.Read(b[:])
+	return string(b[:n]), nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.Issue("site1")
+	site1 := TLS{Cert: cert, Key: key, CA: ca.Path}
+	cert, key = ca.Issue("site2")
+	site2 := TLS{Cert: cert, Key: key, CA: ca.Path}
+
+	if (Config{TLS: site1}).Scheme() != "https" || (Config{}).Scheme() != "http" {
+		t.Fatalf("Expected https only with a certificate")
+	}
+
+	server := serveTLS(t, site1)
+	if cn, err := call(t, site2, server.URL); err != nil || cn != "site2" {
+		t.Fatalf("Expected site2 to be authenticated, got %q: %v", cn, err)
+	}
+	if cn, err := call(t, TLS{CA: ca.Path}, server.URL); err != nil || cn != "" {
+		t.Fatalf("Expected a client without certificate to be accepted, got %q: %v", cn, err)
+	}
+	if _, err := call(t, TLS{Cert: site2.Cert, Key: site2.Key}, server.URL); err == nil {
+		t.Fatalf("Expected the certificate of the server to be unknown without the CA")
+	}
+
+	// Another CA signs certificates that are refused
+	other := newTestCA(t)
+	cert, key = other.Issue("intruder")
+	if _, err := call(t, TLS{Cert: cert, Key: key, CA: ca.Path}, server.URL); err == nil {
+		t.Fatalf("Expected a certificate of another CA to be refused")
+	}
+
+	site1.ClientAuth = true
+	server = serveTLS(t, site1)
+	if _, err := call(t, TLS{CA: ca.Path}, server.URL); err == nil {
+		t.Fatalf("Expected a client without certificate to be refused")
+	}
+	if cn, err := call(t, site2, server.URL); err != nil || cn != "site2" {
+		t.Fatalf("Expected site2 to be authenticated, got %q: %v", cn, err)
+	}
+
+	if _, err := (TLS{Cert: site1.Cert, Key: site1.Key, CA: filepath.Join(t.TempDir(), "ca.pem")}).ServerConfig(); err == nil {
+		t.Fatalf("Expected a missing CA to be an error")
+	}
+}
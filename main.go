@@ -2,17 +2,29 @@
 package main
 
 import (
+	"log"
+
 	"cheops.com/api"
-	"cheops.com/env"
+	"cheops.com/backends"
+	"cheops.com/config"
 	"cheops.com/replicator"
 )
 
-var app = "k8s"
-
 func main() {
-	env.Set()
-	repl := replicator.NewReplicator(7071)
-	go api.Run(8079, repl)
-	go api.RunChephren(8080, repl)
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = backends.SetSandbox(cfg.Execution.Sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = backends.RegisterKubernetes(cfg.Kubernetes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repl := replicator.NewReplicator(cfg)
+	go api.Run(cfg, repl)
+	go api.RunChephren(cfg, repl)
 	select {}
 }
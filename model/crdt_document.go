@@ -19,19 +19,73 @@ type ResourceDocument struct {
 	Operations []Operation
 	Config     ResourceConfig
 
+	// If set, the resource is being deleted: the operation is the cleanup
+	// to run on every location before everything is purged
+	Tombstone *Operation `json:",omitempty"`
+
+	// The last change of locations, if any
+	Relocation *Operation `json:",omitempty"`
+
+	// Sites that were removed from the locations. The document is still sent
+	// to them until they have run their teardown
+	Leaving []Departure `json:",omitempty"`
+
 	// Always RESOURCE
 	Type string
 }
 
+// Departure is a site that was removed from the locations of a resource
+type Departure struct {
+	Site string
+
+	// The relocation that removed the site; the reply to the teardown has
+	// this request id
+	RequestId string
+	Time      time.Time
+
+	// Command to run on the site when it leaves
+	Teardown backends.Command
+
+	// The user that asked for the relocation, if known
+	Identity string `json:",omitempty"`
+
+	// Set when the teardown has been run
+	Done bool
+}
+
 type ReplyDocument struct {
 	Locations  []string
 	Site       string
 	RequestId  string
 	ResourceId string
 
-	// "OK" or "KO"
+	// "OK", "KO", or "TIMEOUT" if the command ran for too long
 	Status string
 	Cmd
+
+	// Exit code of the command. It is also 0 when the command couldn't be
+	// started at all
+	ExitCode int
+
+	// How long the command ran
+	Duration Duration `json:",omitempty"`
+
+	// Why the command failed, for programs: one of not-found, killed,
+	// timeout, canceled, non-zero-exit, refused, skipped or internal. Empty
+	// if it succeeded
+	ErrorClass string `json:",omitempty"`
+
+	// The objects of a cluster touched by the command, for the backends
+	// that manage some
+	Objects []backends.Object `json:",omitempty"`
+
+	// The user that asked for the operation, if known
+	Identity string `json:",omitempty"`
+
+	// How many times the operation was run on the site, including this
+	// one
+	Attempt int
+
 	ExecutionTime time.Time
 
 	// Always REPLY
@@ -39,8 +93,17 @@ type ReplyDocument struct {
 }
 
 type Cmd struct {
-	Input  string
+	Input string
+
+	// stdout and stderr together, in the order they were read; writes to
+	// both that are close in time may not be in the order they were made
 	Output string
+
+	Stdout string `json:",omitempty"`
+	Stderr string `json:",omitempty"`
+
+	// true if the outputs were cut because they were too long
+	Truncated bool `json:",omitempty"`
 }
 
 type RelationType string
@@ -58,6 +121,14 @@ type OperationType string
 type Operation struct {
 	Type      OperationType
 	RequestId string
-	Command   backends.ShellCommand
+	Command   backends.Command
 	Time      time.Time
+
+	// How long the command can run on each site before it is killed. If
+	// 0, the Timeout of the resource config is used
+	Timeout Duration `json:",omitempty"`
+
+	// The user that asked for the operation, when the API authenticates
+	// its callers
+	Identity string `json:",omitempty"`
 }
@@ -1,5 +1,13 @@
 package model
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cheops.com/backends"
+)
+
 type Mode string
 
 const (
@@ -9,10 +17,131 @@ const (
 
 type ResourceConfig struct {
 	ResolutionMatrix []Resolution
+
+	// Shell command to run on every location when the resource is
+	// deleted, if the deletion doesn't give one
+	Cleanup string `json:",omitempty"`
+
+	// Template to run instead of Cleanup, with its parameters. Each
+	// location makes the command from its own template, so that sites
+	// that only run templates can clean up too
+	CleanupTemplate string            `json:",omitempty"`
+	CleanupParams   map[string]string `json:",omitempty"`
+
+	// Types of the operations that capture the whole state of the
+	// resource. Once every location has run one successfully, the
+	// operations before it are dropped.
+	Snapshots []OperationType `json:",omitempty"`
+
+	// How operations that fail are run again, by type. Operations of
+	// other types are run once
+	RetryPolicies []RetryPolicy `json:",omitempty"`
+
+	// How long commands can run before they are killed, unless the
+	// operation says otherwise. 0 means forever
+	Timeout Duration `json:",omitempty"`
 }
 
 func (c ResourceConfig) IsEmpty() bool {
-	return len(c.ResolutionMatrix) == 0
+	return len(c.ResolutionMatrix) == 0 && c.Cleanup == "" && c.CleanupTemplate == "" && len(c.Snapshots) == 0 && len(c.RetryPolicies) == 0 && c.Timeout == 0
+}
+
+// CommandTimeout returns how long the command of the operation can run
+func (c ResourceConfig) CommandTimeout(op Operation) time.Duration {
+	if op.Timeout > 0 {
+		return time.Duration(op.Timeout)
+	}
+	return time.Duration(c.Timeout)
+}
+
+// RetryPolicy returns the retry policy of the operations of the given type.
+// Without one, operations are attempted once
+func (c ResourceConfig) RetryPolicy(t OperationType) RetryPolicy {
+	for _, policy := range c.RetryPolicies {
+		if policy.Type == t {
+			return policy
+		}
+	}
+	return RetryPolicy{Type: t, MaxAttempts: 1}
+}
+
+// RetryPolicy tells how many times an operation that fails is attempted
+type RetryPolicy struct {
+	Type OperationType
+
+	// Including the first one
+	MaxAttempts int
+
+	// Time to wait before the second attempt. It doubles after every
+	// attempt
+	Backoff Duration `json:",omitempty"`
+
+	// Exit codes of the failures worth another attempt. If empty, all
+	// failures are
+	RetryableExitCodes []int `json:",omitempty"`
+}
+
+// ShouldRetry returns true if the reply is a failure that deserves another
+// attempt. Commands that were canceled, refused or skipped are never
+// attempted again
+func (p RetryPolicy) ShouldRetry(reply ReplyDocument) bool {
+	attempt := reply.Attempt
+	if attempt < 1 {
+		// Replies from before attempts were counted
+		attempt = 1
+	}
+	if reply.Status == "OK" || attempt >= p.MaxAttempts || reply.ErrorClass == backends.ErrorCanceled || reply.ErrorClass == backends.ErrorRefused || reply.ErrorClass == backends.ErrorSkipped {
+		return false
+	}
+	if len(p.RetryableExitCodes) == 0 {
+		return true
+	}
+	for _, code := range p.RetryableExitCodes {
+		if code == reply.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the time to wait after the given attempt failed
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := time.Duration(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// Duration is a time.Duration written as a string in json, such as "10s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("a duration must be a string such as \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// IsSnapshot returns true if operations of the given type are snapshots
+func (c ResourceConfig) IsSnapshot(t OperationType) bool {
+	for _, snapshot := range c.Snapshots {
+		if snapshot == t {
+			return true
+		}
+	}
+	return false
 }
 
 type ResolutionType string
@@ -0,0 +1,202 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"cheops.com/model"
+)
+
+// replyGrace is how long replies are kept even if their operation was
+// superseded, so that whoever is waiting for them still gets them
+const replyGrace = time.Minute
+
+// compactEvery runs a compaction at every interval until ctx is done. A zero
+// interval disables compaction.
+func (r *Replicator) compactEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			r.compact(ctx, time.Now().Add(-replyGrace))
+		}
+	}()
+}
+
+// compact drops the operations that are before an acknowledged snapshot,
+// removes the replies to operations that are not in the block of their
+// resource anymore if they were executed before the given time, then
+// compacts the store
+func (r *Replicator) compact(ctx context.Context, before time.Time) {
+	errors := 0
+	dropped := 0
+	removed := 0
+
+	keys, err := r.s.Groups(ctx, "all-by-resourceid", 1)
+	if err != nil {
+		log.Printf("Couldn't list resources to compact: %v\n", err)
+		errors++
+	}
+	for _, key := range keys {
+		truncated, purged, err := r.compactResource(ctx, key[0], before)
+		if err != nil {
+			log.Printf("Couldn't compact %s: %v\n", key[0], err)
+			errors++
+		}
+		dropped += truncated
+		removed += purged
+	}
+
+	reclaimed, err := r.s.Compact(ctx)
+	if err != nil {
+		log.Printf("Couldn't compact the store: %v\n", err)
+		errors++
+	}
+	log.Printf("Compaction done: operations=%d replies=%d bytes=%d errors=%d\n", dropped, removed, reclaimed, errors)
+
+	r.metrics.Lock()
+	defer r.metrics.Unlock()
+	m := &r.metrics.Compaction
+	m.Runs++
+	m.LastRun = time.Now()
+	m.Errors += errors
+	m.OperationsDropped += dropped
+	m.RepliesRemoved += removed
+	m.BytesReclaimed += reclaimed
+}
+
+// compactResource truncates the block of the resource at its last
+// acknowledged snapshot and purges the replies that are not needed anymore.
+// It returns the number of operations dropped and of replies purged.
+// Replies are only kept for the operations of the block and for the
+// departures of sites; nothing is done while the resource has conflicts or
+// is being deleted.
+func (r *Replicator) compactResource(ctx context.Context, id string, before time.Time) (dropped int, removed int, err error) {
+	j, err := r.s.Get(ctx, id)
+	if err == ErrNotFound {
+		// The replies arrived before the resource, or it is being purged
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var d model.ResourceDocument
+	err = json.Unmarshal(j, &d)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid resource document: %v", err)
+	}
+	if d.Type != "RESOURCE" || len(d.Conflicts) > 0 || d.Tombstone != nil {
+		return 0, 0, nil
+	}
+
+	allDocs, err := r.getAllDocsFor(ctx, id, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	// reply id -> reply
+	replies := make(map[string]model.ReplyDocument)
+	for _, doc := range allDocs {
+		var reply struct {
+			Id string `json:"_id"`
+			model.ReplyDocument
+		}
+		err := json.Unmarshal(doc, &reply)
+		if err == nil && reply.Type == "REPLY" {
+			replies[reply.Id] = reply.ReplyDocument
+		}
+	}
+
+	if i := acknowledgedSnapshot(d, replies); i > 0 {
+		d.Operations = d.Operations[i:]
+		err = r.s.Put(ctx, id, d)
+		if err != nil {
+			// It will be done at the next compaction
+			return 0, 0, fmt.Errorf("Couldn't truncate operations: %v", err)
+		}
+		dropped = i
+		log.Printf("Truncated resource=%s operations=%d\n", id, i)
+	}
+
+	live := make(map[string]bool)
+	for _, op := range d.Operations {
+		live[op.RequestId] = true
+	}
+	for _, departure := range d.Leaving {
+		live[departure.RequestId] = true
+	}
+
+	stale := make([]string, 0)
+	for replyId, reply := range replies {
+		if !live[reply.RequestId] && reply.ExecutionTime.Before(before) {
+			stale = append(stale, replyId)
+		}
+	}
+	if len(stale) == 0 {
+		return dropped, 0, nil
+	}
+
+	err = r.s.Purge(ctx, stale...)
+	if err != nil {
+		return dropped, 0, err
+	}
+	return dropped, len(stale), nil
+}
+
+// acknowledgedSnapshot returns the index of the last snapshot of the block
+// that every location ran successfully, or 0 if there is none
+func acknowledgedSnapshot(d model.ResourceDocument, replies map[string]model.ReplyDocument) int {
+	// site -> its replies since it last joined
+	bySite := make(map[string][]model.ReplyDocument)
+	for _, reply := range replies {
+		bySite[reply.Site] = append(bySite[reply.Site], reply)
+	}
+	for site := range bySite {
+		bySite[site] = repliesSinceDeparture(d, site, bySite[site])
+	}
+
+	ranEverywhere := func(op model.Operation) bool {
+		for _, location := range d.Locations {
+			ran := false
+			for _, reply := range bySite[location] {
+				if reply.RequestId == op.RequestId && reply.Status == "OK" {
+					ran = true
+				}
+			}
+			if !ran {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := len(d.Operations) - 1; i > 0; i-- {
+		op := d.Operations[i]
+		if d.Config.IsSnapshot(op.Type) && ranEverywhere(op) {
+			return i
+		}
+	}
+	return 0
+}
+
+// lastSnapshot returns the index of the last snapshot of the operations, or
+// 0 if there is none
+func lastSnapshot(ops []model.Operation, config model.ResourceConfig) int {
+	for i := len(ops) - 1; i > 0; i-- {
+		if config.IsSnapshot(ops[i].Type) {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"cheops.com/config"
+)
+
+// fakeCouch keeps the replicator settings and the replication documents
+// that a CouchDB server is given
+type fakeCouch struct {
+	sync.Mutex
+	settings     map[string]string
+	replications map[string]map[string]interface{}
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_node/_local/_config/replicator/"):
+		var value string
+		json.NewDecoder(r.Body).Decode(&value)
+		f.settings[strings.TrimPrefix(r.URL.Path, "/_node/_local/_config/replicator/")] = value
+		json.NewEncoder(w).Encode("")
+	case r.URL.Path == "/_scheduler/docs":
+		docs := make([]map[string]interface{}, 0)
+		for _, doc := range f.replications {
+			docs = append(docs, map[string]interface{}{"target": doc["target"]})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"docs": docs})
+	case strings.HasPrefix(r.URL.Path, "/_replicator/"):
+		id := strings.TrimPrefix(r.URL.Path, "/_replicator/")
+		existing, ok := f.replications[id]
+		if r.Method == "GET" {
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(existing)
+			return
+		}
+		var doc map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&doc)
+		if ok && doc["_rev"] != existing["_rev"] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		doc["_rev"] = doc["target"]
+		f.replications[id] = doc
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCouchDBReplicationTLS(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeCouch{settings: make(map[string]string), replications: make(map[string]map[string]interface{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := NewCouchDB(server.URL, "cheops", "admin", "")
+	if err := c.Replicate(ctx, "site2"); err != nil {
+		t.Fatalf("Couldn't replicate: %v", err)
+	}
+	if target := fake.replications["cheops-to-site2"]["target"]; target != "http://site2:"+u.Port()+"/cheops/" {
+		t.Fatalf("Unexpected target without TLS: %v", target)
+	}
+
+	err := c.replicateWith(ctx, config.Replication{TLS: true, Port: 6984, CA: "/etc/couchdb/ca.pem", Cert: "/etc/couchdb/site1.pem", Key: "/etc/couchdb/site1.key"})
+	if err != nil {
+		t.Fatalf("Couldn't configure the replication: %v", err)
+	}
+	expected := map[string]string{
+		"verify_ssl_certificates":       "true",
+		"ssl_trusted_certificates_file": "/etc/couchdb/ca.pem",
+		"cert_file":                     "/etc/couchdb/site1.pem",
+		"key_file":                      "/etc/couchdb/site1.key",
+	}
+	for key, value := range expected {
+		if fake.settings[key] != value {
+			t.Fatalf("Expected replicator/%s to be %s, got %q", key, value, fake.settings[key])
+		}
+	}
+
+	// The replication over http is outdated, and replaced
+	jobs, err := c.Replications(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get replications: %v", err)
+	}
+	if _, ok := jobs["site2"]; ok {
+		t.Fatalf("Expected the replication over http to be ignored")
+	}
+	if err := c.Replicate(ctx, "site2"); err != nil {
+		t.Fatalf("Couldn't replicate: %v", err)
+	}
+	if target := fake.replications["cheops-to-site2"]["target"]; target != "https://site2:6984/cheops/" {
+		t.Fatalf("Unexpected target with TLS: %v", target)
+	}
+	jobs, _ = c.Replications(ctx)
+	if _, ok := jobs["site2"]; !ok {
+		t.Fatalf("Expected the replication over https to be known")
+	}
+	if err := c.Replicate(ctx, "site2"); err != nil {
+		t.Fatalf("Couldn't replicate again: %v", err)
+	}
+}
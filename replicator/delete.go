@@ -0,0 +1,268 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cheops.com/backends"
+	"cheops.com/model"
+)
+
+// Delete deletes the resource everywhere. A tombstone is replicated to all
+// locations, where the cleanup command of the request is run, or the one of
+// the resource config if the request doesn't have any. Once the cleanup
+// succeeded on every location, the resource and its replies are purged.
+//
+// The output is a chan of the replies to the cleanup, as they arrive. After a
+// timeout or all replies are sent, the chan is closed
+func (r *Replicator) Delete(ctx context.Context, id string, request model.Operation) (replies chan model.ReplyDocument, err error) {
+	repliesCtx, cancel := context.WithCancel(ctx)
+	repliesChan := make(chan model.ReplyDocument)
+	r.watchReplies(repliesCtx, request.RequestId, repliesChan)
+
+	doc, err := r.getResourceDocFor(ctx, id)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if doc.Id == "" {
+		cancel()
+		return nil, ErrDoesNotExist
+	}
+	if doc.Tombstone != nil {
+		cancel()
+		return nil, ErrInvalidRequest("the resource is already being deleted")
+	}
+
+	if request.Command.IsEmpty() {
+		request.Command = r.cleanup(doc.Config)
+	}
+	doc.Tombstone = &request
+	log.Printf("Delete request: resourceId=%v requestId=%v\n", doc.Id, request.RequestId)
+
+	err = r.s.Put(ctx, id, doc)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Couldn't send deletion for %s: %v", id, err)
+	}
+
+	return r.gatherReplies(ctx, doc, request, repliesChan, cancel), nil
+}
+
+// cleanup returns the cleanup of the resource config: its template, that
+// every site makes again from its own, or its shell command
+func (r *Replicator) cleanup(c model.ResourceConfig) backends.Command {
+	if c.CleanupTemplate == "" {
+		return backends.Command{Command: c.Cleanup}
+	}
+	cmd := backends.Command{Template: c.CleanupTemplate, Params: c.CleanupParams}
+	// The command of this site is only there to be shown in the replies
+	if t, ok := r.operations.Template(c.CleanupTemplate); ok {
+		if expanded, err := backends.Expand(t, c.CleanupParams, nil); err == nil {
+			cmd = expanded
+		}
+	}
+	return cmd
+}
+
+// teardown runs the cleanup of a deleted resource on this site, if it wasn't
+// already done
+func (r *Replicator) teardown(ctx context.Context, d model.ResourceDocument) {
+	allDocs, err := r.getAllDocsFor(ctx, d.Id, r.site)
+	if err != nil {
+		log.Printf("Couldn't get docs for id: %v\n", err)
+		return
+	}
+	for _, doc := range allDocs {
+		var reply model.ReplyDocument
+		err := json.Unmarshal(doc, &reply)
+		if err == nil && reply.Type == "REPLY" && reply.RequestId == d.Tombstone.RequestId {
+			// Already cleaned up, maybe everyone else too
+			r.maybePurge(ctx, d.Id)
+			return
+		}
+	}
+
+	reply := model.ReplyDocument{
+		Locations:  d.Locations,
+		Site:       r.site,
+		RequestId:  d.Tombstone.RequestId,
+		ResourceId: d.Id,
+		Status:     "OK",
+		Cmd: model.Cmd{
+			Input: d.Tombstone.Command.Command,
+		},
+		Identity: d.Tombstone.Identity,
+		Type:     "REPLY",
+	}
+	if !d.Tombstone.Command.IsEmpty() {
+		r.execute(ctx, d.Tombstone.Command, d.Config.CommandTimeout(*d.Tombstone), &reply)
+	}
+	reply.ExecutionTime = time.Now()
+
+	err = r.s.Post(ctx, reply)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Cleaned up resource=%s status=%s\n", d.Id, reply.Status)
+
+	r.maybePurge(ctx, d.Id)
+}
+
+// maybePurge purges the resource and all its replies if it is deleted and
+// the cleanup succeeded on every location. If it failed on one of them, the
+// tombstone and the replies are kept so that the failure can be looked into
+func (r *Replicator) maybePurge(ctx context.Context, id string) {
+	j, err := r.s.Get(ctx, id)
+	if err != nil {
+		return
+	}
+	var d model.ResourceDocument
+	err = json.Unmarshal(j, &d)
+	if err != nil || d.Tombstone == nil {
+		return
+	}
+
+	allDocs, err := r.getAllDocsFor(ctx, id, "")
+	if err != nil {
+		log.Printf("Couldn't get docs for id: %v\n", err)
+		return
+	}
+
+	ids := []string{id}
+	cleanedUp := make(map[string]bool)
+	for _, doc := range allDocs {
+		var reply struct {
+			Id string `json:"_id"`
+			model.ReplyDocument
+		}
+		err := json.Unmarshal(doc, &reply)
+		if err != nil || reply.Type != "REPLY" {
+			continue
+		}
+		ids = append(ids, reply.Id)
+		if reply.RequestId == d.Tombstone.RequestId && reply.Status == "OK" {
+			cleanedUp[reply.Site] = true
+		}
+	}
+
+	for _, location := range d.Locations {
+		if !cleanedUp[location] {
+			return
+		}
+	}
+
+	err = r.s.Purge(ctx, ids...)
+	if err != nil {
+		log.Printf("Couldn't purge %s: %v\n", id, err)
+		return
+	}
+	r.purged.add(ctx, d.Tombstone.RequestId, ids[1:])
+	log.Printf("Purged resource=%s\n", id)
+}
+
+// purgedDocs remembers what was purged. Purges are not replicated, so
+// another site that hasn't purged yet can send us the same documents again;
+// they must be purged again. What was purged is saved in a local document of
+// the store, so that it is still known after a restart
+type purgedDocs struct {
+	sync.Mutex
+	s Store
+
+	// request ids of the deletions
+	tombstones map[string]bool
+
+	// ids of the replies
+	replies map[string]bool
+}
+
+// purgedDocName is the name of the local document of purgedDocs
+const purgedDocName = "purged"
+
+// savedPurges is the local document of purgedDocs
+type savedPurges struct {
+	Tombstones []string
+	Replies    []string
+}
+
+func newPurgedDocs(ctx context.Context, s Store) *purgedDocs {
+	p := &purgedDocs{
+		s:          s,
+		tombstones: make(map[string]bool),
+		replies:    make(map[string]bool),
+	}
+
+	j, err := s.LocalDoc(ctx, purgedDocName)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Printf("Couldn't get purged documents: %v\n", err)
+		}
+		return p
+	}
+	var saved savedPurges
+	err = json.Unmarshal(j, &saved)
+	if err != nil {
+		log.Printf("Couldn't decode purged documents: %v\n", err)
+		return p
+	}
+	for _, tombstone := range saved.Tombstones {
+		p.tombstones[tombstone] = true
+	}
+	for _, id := range saved.Replies {
+		p.replies[id] = true
+	}
+	return p
+}
+
+func (p *purgedDocs) add(ctx context.Context, tombstone string, replies []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.tombstones[tombstone] = true
+	for _, id := range replies {
+		p.replies[id] = true
+	}
+
+	saved := savedPurges{
+		Tombstones: make([]string, 0, len(p.tombstones)),
+		Replies:    make([]string, 0, len(p.replies)),
+	}
+	for tombstone := range p.tombstones {
+		saved.Tombstones = append(saved.Tombstones, tombstone)
+	}
+	for id := range p.replies {
+		saved.Replies = append(saved.Replies, id)
+	}
+	err := p.s.SetLocalDoc(ctx, purgedDocName, saved)
+	if err != nil {
+		log.Printf("Couldn't save purged documents: %v\n", err)
+	}
+}
+
+// contains returns true if the document is one that was purged
+func (p *purgedDocs) contains(j json.RawMessage) bool {
+	var d struct {
+		Id        string `json:"_id"`
+		Type      string
+		Tombstone *model.Operation
+	}
+	if json.Unmarshal(j, &d) != nil {
+		return false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	switch d.Type {
+	case "RESOURCE":
+		return d.Tombstone != nil && p.tombstones[d.Tombstone.RequestId]
+	case "REPLY":
+		return p.replies[d.Id]
+	}
+	return false
+}
@@ -2,29 +2,46 @@ package replicator
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"encoding/json"
 	"log"
 	"net/http"
+
+	"cheops.com/config"
 )
 
-func (r *Replicator) listenDump(port int) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// listenDump serves every document of the database. The dump isn't
+// authenticated, so it isn't served when authentication is enabled
+func (r *Replicator) listenDump(cfg config.Config) {
+	if cfg.Auth.Enabled {
+		log.Println("Authentication is enabled, not serving the dump")
+		return
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 
-		req, err := http.NewRequestWithContext(r.Context(), "GET", "http://localhost:5984/cheops/_all_docs?include_docs=true", nil)
+		docs, err := r.s.AllDocs(req.Context())
 		if err != nil {
 			log.Println(err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
+
+		type row struct {
+			Doc json.RawMessage `json:"doc"`
+		}
+		type allDocs struct {
+			TotalRows int   `json:"total_rows"`
+			Rows      []row `json:"rows"`
+		}
+
+		ad := allDocs{
+			TotalRows: len(docs),
+			Rows:      make([]row, 0, len(docs)),
+		}
+		for _, doc := range docs {
+			ad.Rows = append(ad.Rows, row{Doc: doc})
 		}
-		defer resp.Body.Close()
-		io.Copy(w, resp.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ad)
 
 		/*
 
@@ -102,7 +119,7 @@ func (r *Replicator) listenDump(port int) {
 		*/
 	})
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+		err := cfg.ListenAndServe(config.ServiceDump, nil)
 		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
@@ -0,0 +1,156 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"cheops.com/model"
+)
+
+// Types of events
+const (
+	// A new operation was added to a resource
+	EventOperation = "operation"
+
+	// Conflicting versions of a resource were merged on this site
+	EventMerge = "merge"
+
+	// A site replied to a request
+	EventReply = "reply"
+
+	// A replication to a site was created or removed
+	EventReplication = "replication"
+)
+
+// Event is something that happened to the resources, as seen from this site
+type Event struct {
+	// One of the Event* constants
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Empty for replication events
+	ResourceId string `json:"resourceId,omitempty"`
+
+	// The site that replied, that merged, or that is replicated to
+	Site string `json:"site,omitempty"`
+
+	// The locations of the resource, for operations and merges
+	Locations []string `json:"locations,omitempty"`
+
+	Operation *model.Operation     `json:"operation,omitempty"`
+	Reply     *model.ReplyDocument `json:"reply,omitempty"`
+
+	// For replication events, true if the replication was created
+	Replicating bool `json:"replicating,omitempty"`
+}
+
+// Concerns returns true if the event is about the resource, if not empty,
+// and about the site, if not empty
+func (e Event) Concerns(resourceId, site string) bool {
+	if resourceId != "" && e.ResourceId != resourceId {
+		return false
+	}
+	if site == "" || e.Site == site {
+		return true
+	}
+	for _, location := range e.Locations {
+		if location == site {
+			return true
+		}
+	}
+	return false
+}
+
+// eventDocument is how events that are not in the database go through the
+// watchers
+type eventDocument struct {
+	// Always EVENT
+	Type  string
+	Event Event
+}
+
+// publish sends the event to the watchers of events
+func (r *Replicator) publish(e Event) {
+	e.Time = time.Now()
+	j, err := json.Marshal(eventDocument{Type: "EVENT", Event: e})
+	if err != nil {
+		log.Printf("Couldn't encode event: %v\n", err)
+		return
+	}
+	r.w.dispatch(j)
+}
+
+// WatchEvents runs f on every event until ctx is done. Operations are only
+// sent once; the first time a resource is seen, its operations from before
+// WatchEvents was called are not sent.
+func (r *Replicator) WatchEvents(ctx context.Context, f func(Event)) {
+	started := time.Now()
+
+	// resource id -> request ids of the operations already seen
+	known := make(map[string]map[string]bool)
+
+	cancel := r.w.watch(func(j json.RawMessage) {
+		var d struct {
+			Type    string
+			Deleted bool `json:"_deleted"`
+		}
+		err := json.Unmarshal(j, &d)
+		if err != nil || d.Deleted {
+			return
+		}
+
+		switch d.Type {
+		case "EVENT":
+			var e eventDocument
+			if err := json.Unmarshal(j, &e); err == nil {
+				f(e.Event)
+			}
+		case "REPLY":
+			var reply model.ReplyDocument
+			if err := json.Unmarshal(j, &reply); err != nil {
+				return
+			}
+			f(Event{
+				Type:       EventReply,
+				Time:       reply.ExecutionTime,
+				ResourceId: reply.ResourceId,
+				Site:       reply.Site,
+				Reply:      &reply,
+			})
+		case "RESOURCE":
+			var doc model.ResourceDocument
+			if err := json.Unmarshal(j, &doc); err != nil {
+				return
+			}
+			seen, ok := known[doc.Id]
+			if !ok {
+				seen = make(map[string]bool)
+				known[doc.Id] = seen
+			}
+			for i := range doc.Operations {
+				op := doc.Operations[i]
+				if seen[op.RequestId] {
+					continue
+				}
+				seen[op.RequestId] = true
+				if !ok && op.Time.Before(started) {
+					continue
+				}
+				f(Event{
+					Type:       EventOperation,
+					Time:       op.Time,
+					ResourceId: doc.Id,
+					Locations:  doc.Locations,
+					Operation:  &op,
+				})
+			}
+		}
+	})
+
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+}
@@ -0,0 +1,129 @@
+package replicator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"cheops.com/model"
+)
+
+// eventRecorder keeps the events seen by a site
+type eventRecorder struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(e Event) {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+// wait waits until an event matching f was recorded
+func (r *eventRecorder) wait(t *testing.T, what string, f func(Event) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		for _, e := range r.events {
+			if f(e) {
+				r.Unlock()
+				return
+			}
+		}
+		r.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s, got %v", what, r.events)
+}
+
+// count returns how many recorded events match f
+func (r *eventRecorder) count(f func(Event) bool) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, e := range r.events {
+		if f(e) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEvents(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+	recorders := make(map[string]*eventRecorder)
+	for _, site := range sites {
+		recorders[site] = &eventRecorder{}
+		sim.replicators[site].WatchEvents(sim.ctx, recorders[site].record)
+	}
+	s1 := recorders["s1"]
+
+	set := sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+	s1.wait(t, "the operation", func(e Event) bool {
+		return e.Type == EventOperation && e.ResourceId == "res" && e.Operation.RequestId == set
+	})
+	s1.wait(t, "the replication to s2", func(e Event) bool {
+		return e.Type == EventReplication && e.Site == "s2" && e.Replicating
+	})
+	for _, site := range sites {
+		site := site
+		s1.wait(t, "the reply of "+site, func(e Event) bool {
+			return e.Type == EventReply && e.Site == site && e.Reply.RequestId == set
+		})
+	}
+	isSet := func(e Event) bool {
+		return e.Type == EventOperation && e.Operation.RequestId == set
+	}
+	if n := s1.count(isSet); n != 1 {
+		t.Fatalf("Expected the operation once, got it %d times", n)
+	}
+
+	// Concurrent operations are merged by one of the sites
+	sim.isolate("s2")
+	sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+	sim.healAll()
+	sim.settle()
+	deadline := time.Now().Add(5 * time.Second)
+	isMerge := func(e Event) bool {
+		return e.Type == EventMerge && e.ResourceId == "res"
+	}
+	for recorders["s1"].count(isMerge)+recorders["s2"].count(isMerge) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a merge event")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventConcerns(t *testing.T) {
+	operation := Event{Type: EventOperation, ResourceId: "res", Locations: []string{"s1", "s2"}}
+	reply := Event{Type: EventReply, ResourceId: "res", Site: "s2"}
+	replication := Event{Type: EventReplication, Site: "s3"}
+
+	vectors := []struct {
+		e          Event
+		resourceId string
+		site       string
+		expected   bool
+	}{
+		{operation, "", "", true},
+		{operation, "res", "s1", true},
+		{operation, "other", "", false},
+		{operation, "", "s3", false},
+		{reply, "res", "s2", true},
+		{reply, "", "s1", false},
+		{replication, "", "s3", true},
+		{replication, "res", "", false},
+	}
+	for i, v := range vectors {
+		if got := v.e.Concerns(v.resourceId, v.site); got != v.expected {
+			t.Fatalf("vector %d: expected %v, got %v", i, v.expected, got)
+		}
+	}
+}
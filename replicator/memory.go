@@ -0,0 +1,878 @@
+package replicator
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cheops.com/model"
+)
+
+// MemoryNetwork is a set of in-process MemoryStores that replicate with each
+// other like CouchDB instances would. Links between stores can be cut and
+// healed to simulate partitions.
+type MemoryNetwork struct {
+	sync.Mutex
+
+	// site -> store
+	stores map[string]*MemoryStore
+
+	// cut links, keyed by the sorted pair of sites
+	cut map[[2]string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		stores: make(map[string]*MemoryStore),
+		cut:    make(map[[2]string]bool),
+	}
+}
+
+// Store returns the store for the given site, creating it if needed
+func (n *MemoryNetwork) Store(site string) *MemoryStore {
+	n.Lock()
+	defer n.Unlock()
+
+	if s, ok := n.stores[site]; ok {
+		return s
+	}
+	s := &MemoryStore{
+		site:    site,
+		network: n,
+		docs:    make(map[string]*memoryDoc),
+		latest:  make(map[string]int),
+		notify:  make(chan struct{}),
+		jobs:    make(map[string]int),
+		feeds:   make(map[*int]int),
+
+		checkpoints: make(map[string]string),
+		localDocs:   make(map[string]json.RawMessage),
+	}
+	n.stores[site] = s
+	return s
+}
+
+func link(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Partition cuts the link between a and b. Nothing is replicated between
+// them until the link is healed.
+func (n *MemoryNetwork) Partition(a, b string) {
+	n.Lock()
+	n.cut[link(a, b)] = true
+	n.Unlock()
+}
+
+// Heal restores the link between a and b and runs the pending replications
+func (n *MemoryNetwork) Heal(a, b string) {
+	n.Lock()
+	delete(n.cut, link(a, b))
+	n.Unlock()
+	n.Sync()
+}
+
+// Sync runs all replication jobs of all stores
+func (n *MemoryNetwork) Sync() {
+	n.Lock()
+	stores := make([]*MemoryStore, 0, len(n.stores))
+	for _, s := range n.stores {
+		stores = append(stores, s)
+	}
+	n.Unlock()
+
+	sort.Slice(stores, func(i, j int) bool { return stores[i].site < stores[j].site })
+	for _, s := range stores {
+		s.replicateAll()
+	}
+}
+
+// Idle returns true if all stores are idle and there is nothing left to
+// replicate
+func (n *MemoryNetwork) Idle() bool {
+	n.Lock()
+	stores := make([]*MemoryStore, 0, len(n.stores))
+	for _, s := range n.stores {
+		stores = append(stores, s)
+	}
+	n.Unlock()
+
+	for _, s := range stores {
+		if !s.Idle() {
+			return false
+		}
+		s.Lock()
+		pending := false
+		for target, sent := range s.jobs {
+			if sent < s.seq && n.reachable(s.site, target) != nil {
+				pending = true
+			}
+		}
+		s.Unlock()
+		if pending {
+			return false
+		}
+	}
+	return true
+}
+
+// reachable returns the target store if the link from source to it is up
+func (n *MemoryNetwork) reachable(source, target string) *MemoryStore {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.cut[link(source, target)] {
+		return nil
+	}
+	return n.stores[target]
+}
+
+// MemoryStore is a Store kept in memory. It mimics the parts of CouchDB
+// that Cheops relies on: revision trees with deterministic winners and
+// conflicts, views, the changes feed and filtered continuous replication.
+type MemoryStore struct {
+	sync.Mutex
+
+	site    string
+	network *MemoryNetwork
+
+	docs map[string]*memoryDoc
+
+	// sequence of the last change
+	seq int
+
+	// changes feed, in order
+	changes []memoryChange
+
+	// id -> seq of the latest change for that id
+	latest map[string]int
+
+	// closed and replaced at every change
+	notify chan struct{}
+
+	// replication jobs: target -> last seq sent
+	jobs map[string]int
+
+	// followers of the changes feed -> last seq they finished processing
+	feeds map[*int]int
+
+	// name -> seq
+	checkpoints map[string]string
+
+	// name -> local document
+	localDocs map[string]json.RawMessage
+}
+
+type memoryChange struct {
+	seq int
+	id  string
+}
+
+type memoryDoc struct {
+	id   string
+	revs map[string]*memoryRev
+}
+
+type memoryRev struct {
+	rev     string
+	parent  string
+	deleted bool
+
+	// body of the revision, without the underscore fields
+	body map[string]json.RawMessage
+}
+
+func revGeneration(rev string) int {
+	gen, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return gen
+}
+
+// revLess orders revisions the way CouchDB picks a winner: higher
+// generation first, then higher revision hash
+func revLess(a, b string) bool {
+	ga, gb := revGeneration(a), revGeneration(b)
+	if ga != gb {
+		return ga < gb
+	}
+	return a < b
+}
+
+// leaves returns the leaf revisions, with the winner first
+func (d *memoryDoc) leaves() []*memoryRev {
+	hasChild := make(map[string]bool)
+	for _, r := range d.revs {
+		hasChild[r.parent] = true
+	}
+
+	leaves := make([]*memoryRev, 0)
+	for rev, r := range d.revs {
+		if !hasChild[rev] {
+			leaves = append(leaves, r)
+		}
+	}
+
+	sort.Slice(leaves, func(i, j int) bool {
+		if leaves[i].deleted != leaves[j].deleted {
+			return !leaves[i].deleted
+		}
+		return revLess(leaves[j].rev, leaves[i].rev)
+	})
+	return leaves
+}
+
+func (d *memoryDoc) winner() *memoryRev {
+	return d.leaves()[0]
+}
+
+// isLiveLeaf returns true if rev is a leaf revision that is not deleted
+func (d *memoryDoc) isLiveLeaf(rev string) bool {
+	for _, leaf := range d.leaves() {
+		if leaf.rev == rev {
+			return !leaf.deleted
+		}
+	}
+	return false
+}
+
+// replicatesTo returns true if the document is destined to the given location
+func (d *memoryDoc) replicatesTo(location string) bool {
+	for _, r := range d.leaves() {
+		var locations []string
+		if err := json.Unmarshal(r.body["Locations"], &locations); err == nil {
+			for _, l := range locations {
+				if l == location {
+					return true
+				}
+			}
+		}
+		var leaving []model.Departure
+		if err := json.Unmarshal(r.body["Leaving"], &leaving); err == nil {
+			for _, departure := range leaving {
+				if departure.Site == location && !departure.Done {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (r *memoryRev) marshal(id string, conflicts []string) json.RawMessage {
+	m := make(map[string]interface{})
+	for k, v := range r.body {
+		m[k] = v
+	}
+	m["_id"] = id
+	m["_rev"] = r.rev
+	if r.deleted {
+		m["_deleted"] = true
+	}
+	if len(conflicts) > 0 {
+		m["_conflicts"] = conflicts
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// changed records a change for the given id; the caller must hold the lock
+func (s *MemoryStore) changed(id string) {
+	s.seq++
+	s.changes = append(s.changes, memoryChange{seq: s.seq, id: id})
+	s.latest[id] = s.seq
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (json.RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.docs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	leaves := d.leaves()
+	if leaves[0].deleted {
+		return nil, ErrNotFound
+	}
+	conflicts := make([]string, 0)
+	for _, leaf := range leaves[1:] {
+		if !leaf.deleted {
+			conflicts = append(conflicts, leaf.rev)
+		}
+	}
+	return leaves[0].marshal(id, conflicts), nil
+}
+
+func (s *MemoryStore) GetRev(ctx context.Context, id, rev string) (json.RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.docs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	r, ok := d.revs[rev]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r.marshal(id, nil), nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, id string, doc interface{}) error {
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("Couldn't marshal document: %v", err)
+	}
+	var body map[string]json.RawMessage
+	err = json.Unmarshal(buf, &body)
+	if err != nil {
+		return fmt.Errorf("Invalid document: %v", err)
+	}
+
+	var rev string
+	json.Unmarshal(body["_rev"], &rev)
+	var deleted bool
+	json.Unmarshal(body["_deleted"], &deleted)
+	for k := range body {
+		if strings.HasPrefix(k, "_") {
+			delete(body, k)
+		}
+	}
+
+	err = s.write(id, rev, deleted, body)
+	if err != nil {
+		return err
+	}
+	s.replicateAll()
+	return nil
+}
+
+// write adds a new revision on top of parent
+func (s *MemoryStore) write(id, parent string, deleted bool, body map[string]json.RawMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.docs[id]
+	if !ok {
+		if parent != "" {
+			return ErrConflict
+		}
+		d = &memoryDoc{id: id, revs: make(map[string]*memoryRev)}
+		s.docs[id] = d
+	} else if winner := d.winner(); winner.deleted {
+		// Recreating a deleted document continues its history
+		if parent != "" && parent != winner.rev {
+			return ErrConflict
+		}
+		parent = winner.rev
+	} else if !d.isLiveLeaf(parent) {
+		return ErrConflict
+	}
+
+	b, _ := json.Marshal(body)
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%v/", parent, deleted)
+	h.Write(b)
+	rev := fmt.Sprintf("%d-%s", revGeneration(parent)+1, hex.EncodeToString(h.Sum(nil)))
+
+	d.revs[rev] = &memoryRev{
+		rev:     rev,
+		parent:  parent,
+		deleted: deleted,
+		body:    body,
+	}
+	s.changed(id)
+	return nil
+}
+
+func (s *MemoryStore) Post(ctx context.Context, doc interface{}) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, hex.EncodeToString(b), doc)
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id, rev string) error {
+	s.Lock()
+	d, ok := s.docs[id]
+	if !ok || !d.isLiveLeaf(rev) {
+		s.Unlock()
+		return ErrConflict
+	}
+	s.Unlock()
+
+	err := s.write(id, rev, true, map[string]json.RawMessage{})
+	if err != nil {
+		return err
+	}
+	s.replicateAll()
+	return nil
+}
+
+func (s *MemoryStore) Purge(ctx context.Context, ids ...string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	purged := make(map[string]bool)
+	for _, id := range ids {
+		delete(s.docs, id)
+		delete(s.latest, id)
+		purged[id] = true
+	}
+
+	changes := make([]memoryChange, 0, len(s.changes))
+	for _, c := range s.changes {
+		if !purged[c.id] {
+			changes = append(changes, c)
+		}
+	}
+	s.changes = changes
+	return nil
+}
+
+// Compact drops the bodies of the revisions that are not leaves, like
+// CouchDB does
+func (s *MemoryStore) Compact(ctx context.Context) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var reclaimed int64
+	for _, d := range s.docs {
+		leaves := make(map[string]bool)
+		for _, leaf := range d.leaves() {
+			leaves[leaf.rev] = true
+		}
+		for rev, r := range d.revs {
+			if leaves[rev] || r.body == nil {
+				continue
+			}
+			for k, v := range r.body {
+				reclaimed += int64(len(k) + len(v))
+			}
+			// Revisions are shared with the stores they were
+			// replicated to
+			d.revs[rev] = &memoryRev{
+				rev:     r.rev,
+				parent:  r.parent,
+				deleted: r.deleted,
+			}
+		}
+	}
+	return reclaimed, nil
+}
+
+type memoryViewRow struct {
+	key []string
+	id  string
+	doc json.RawMessage
+}
+
+// view computes the rows of the given view, sorted by key then id.
+// The caller must hold the lock
+func (s *MemoryStore) view(view string) ([]memoryViewRow, error) {
+	rows := make([]memoryViewRow, 0)
+	for id, d := range s.docs {
+		winner := d.winner()
+		if winner.deleted {
+			continue
+		}
+
+		var doc struct {
+			Type       string
+			Locations  []string
+			Operations []model.Operation
+			Tombstone  *model.Operation
+			Relocation *model.Operation
+			Leaving    []model.Departure
+			ResourceId string
+			RequestId  string
+			Site       string
+		}
+		b := winner.marshal(id, nil)
+		if err := json.Unmarshal(b, &doc); err != nil {
+			continue
+		}
+
+		emit := func(key ...string) {
+			rows = append(rows, memoryViewRow{key: key, id: id, doc: b})
+		}
+
+		switch view {
+		case "all-by-resourceid":
+			switch doc.Type {
+			case "RESOURCE":
+				for _, site := range doc.Locations {
+					emit(id, site)
+				}
+			case "REPLY":
+				emit(doc.ResourceId, doc.Site)
+			}
+		case "last-reply":
+			if doc.Type == "REPLY" {
+				emit(doc.Site, doc.ResourceId)
+			}
+		case "by-location":
+			if doc.Type == "RESOURCE" {
+				for _, site := range doc.Locations {
+					emit(site, id)
+				}
+				for _, departure := range doc.Leaving {
+					if !departure.Done {
+						emit(departure.Site, id)
+					}
+				}
+			}
+		case "by-request":
+			switch doc.Type {
+			case "RESOURCE":
+				for _, op := range doc.Operations {
+					emit(op.RequestId)
+				}
+				if doc.Tombstone != nil {
+					emit(doc.Tombstone.RequestId)
+				}
+				if doc.Relocation != nil {
+					emit(doc.Relocation.RequestId)
+				}
+				for _, departure := range doc.Leaving {
+					emit(departure.RequestId)
+				}
+			case "REPLY":
+				emit(doc.RequestId, doc.Site)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown view %s", view)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := strings.Join(rows[i].key, "\x00"), strings.Join(rows[j].key, "\x00")
+		if a != b {
+			return a < b
+		}
+		return rows[i].id < rows[j].id
+	})
+	return rows, nil
+}
+
+func (s *MemoryStore) Query(ctx context.Context, view string, key ...string) ([]json.RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	rows, err := s.view(view)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]string, 0)
+	for _, part := range key {
+		if part != "" {
+			prefix = append(prefix, part)
+		}
+	}
+
+	docs := make([]json.RawMessage, 0)
+rows:
+	for _, row := range rows {
+		if len(row.key) < len(prefix) {
+			continue
+		}
+		for i := range prefix {
+			if row.key[i] != prefix[i] {
+				continue rows
+			}
+		}
+		docs = append(docs, row.doc)
+	}
+	return docs, nil
+}
+
+func (s *MemoryStore) Groups(ctx context.Context, view string, level int) ([][]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	rows, err := s.view(view)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]string, 0)
+	last := ""
+	for _, row := range rows {
+		key := row.key
+		if len(key) > level {
+			key = key[:level]
+		}
+		joined := strings.Join(key, "\x00")
+		if len(keys) > 0 && joined == last {
+			continue
+		}
+		keys = append(keys, key)
+		last = joined
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) AllDocs(ctx context.Context) ([]json.RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := make([]string, 0, len(s.docs))
+	for id, d := range s.docs {
+		if !d.winner().deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	docs := make([]json.RawMessage, 0, len(ids))
+	for _, id := range ids {
+		docs = append(docs, s.docs[id].winner().marshal(id, nil))
+	}
+	return docs, nil
+}
+
+func (s *MemoryStore) Changes(ctx context.Context, since string, onChange func(DocChange)) error {
+	s.Lock()
+	var last int
+	switch since {
+	case "":
+		last = 0
+	case "now":
+		last = s.seq
+	default:
+		var err error
+		last, err = strconv.Atoi(since)
+		if err != nil {
+			s.Unlock()
+			return fmt.Errorf("Invalid since %s: %v", since, err)
+		}
+	}
+	feed := new(int)
+	s.feeds[feed] = last
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.feeds, feed)
+		s.Unlock()
+	}()
+
+	for ctx.Err() == nil {
+		s.Lock()
+		pending := make([]DocChange, 0)
+		for _, c := range s.changes {
+			if c.seq <= last || s.latest[c.id] != c.seq {
+				continue
+			}
+			pending = append(pending, DocChange{
+				Seq: strconv.Itoa(c.seq),
+				Id:  c.id,
+				Doc: s.docs[c.id].winner().marshal(c.id, nil),
+			})
+		}
+		last = s.seq
+		notify := s.notify
+		s.Unlock()
+
+		for _, change := range pending {
+			onChange(change)
+		}
+
+		s.Lock()
+		s.feeds[feed] = last
+		s.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-notify:
+		}
+	}
+	return nil
+}
+
+// Idle returns true if every follower of the changes feed has processed
+// all changes
+func (s *MemoryStore) Idle() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, done := range s.feeds {
+		if done < s.seq {
+			return false
+		}
+	}
+	return true
+}
+
+// Seq returns the sequence of the last change
+func (s *MemoryStore) Seq() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.seq
+}
+
+func (s *MemoryStore) LastSeq(ctx context.Context) (string, error) {
+	return strconv.Itoa(s.Seq()), nil
+}
+
+func (s *MemoryStore) Checkpoint(ctx context.Context, name string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *MemoryStore) SetCheckpoint(ctx context.Context, name, seq string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if seq == "" {
+		delete(s.checkpoints, name)
+	} else {
+		s.checkpoints[name] = seq
+	}
+	return nil
+}
+
+func (s *MemoryStore) LocalDoc(ctx context.Context, name string) (json.RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	j, ok := s.localDocs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+func (s *MemoryStore) SetLocalDoc(ctx context.Context, name string, doc interface{}) error {
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("Couldn't marshal document: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.localDocs[name] = j
+	return nil
+}
+
+func (s *MemoryStore) Replications(ctx context.Context) (map[string]struct{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ret := make(map[string]struct{})
+	for target := range s.jobs {
+		ret[target] = struct{}{}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStore) Replicate(ctx context.Context, location string) error {
+	s.Lock()
+	if _, ok := s.jobs[location]; !ok {
+		s.jobs[location] = 0
+	}
+	s.Unlock()
+
+	s.replicateAll()
+	return nil
+}
+
+func (s *MemoryStore) Unreplicate(ctx context.Context, location string) error {
+	s.Lock()
+	delete(s.jobs, location)
+	s.Unlock()
+	return nil
+}
+
+// replicateAll pushes pending changes to every reachable target
+func (s *MemoryStore) replicateAll() {
+	s.Lock()
+	targets := make([]string, 0, len(s.jobs))
+	for target := range s.jobs {
+		targets = append(targets, target)
+	}
+	s.Unlock()
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		s.replicateTo(target)
+	}
+}
+
+// replicateTo sends to the target all revisions of the documents that
+// changed since the last replication and are destined to it
+func (s *MemoryStore) replicateTo(target string) {
+	t := s.network.reachable(s.site, target)
+	if t == nil || t == s {
+		return
+	}
+
+	s.Lock()
+	since := s.jobs[target]
+	docs := make([]*memoryDoc, 0)
+	for _, c := range s.changes {
+		if c.seq <= since || s.latest[c.id] != c.seq {
+			continue
+		}
+		d := s.docs[c.id]
+		if !d.replicatesTo(target) {
+			continue
+		}
+		revs := make(map[string]*memoryRev, len(d.revs))
+		for rev, r := range d.revs {
+			revs[rev] = r
+		}
+		docs = append(docs, &memoryDoc{id: d.id, revs: revs})
+	}
+	s.jobs[target] = s.seq
+	s.Unlock()
+
+	if t.receive(docs) {
+		t.replicateAll()
+	}
+}
+
+// receive merges the revisions of the given documents and returns true if
+// anything was new
+func (s *MemoryStore) receive(docs []*memoryDoc) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	changed := false
+	for _, doc := range docs {
+		d, ok := s.docs[doc.id]
+		if !ok {
+			d = &memoryDoc{id: doc.id, revs: make(map[string]*memoryRev)}
+			s.docs[doc.id] = d
+		}
+
+		isNew := false
+		for rev, r := range doc.revs {
+			if _, ok := d.revs[rev]; !ok {
+				d.revs[rev] = r
+				isNew = true
+			}
+		}
+		if isNew {
+			s.changed(doc.id)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,148 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cheops.com/backends"
+	"cheops.com/model"
+)
+
+func TestMemoryConflicts(t *testing.T) {
+	ctx := context.Background()
+	n := NewMemoryNetwork()
+	s1 := n.Store("s1")
+	s2 := n.Store("s2")
+	s1.Replicate(ctx, "s2")
+	s2.Replicate(ctx, "s1")
+
+	doc := model.ResourceDocument{
+		Id:        "res",
+		Locations: []string{"s1", "s2"},
+		Type:      "RESOURCE",
+	}
+	err := s1.Put(ctx, "res", doc)
+	if err != nil {
+		t.Fatalf("Couldn't put: %v", err)
+	}
+
+	j, err := s2.Get(ctx, "res")
+	if err != nil {
+		t.Fatalf("Document not replicated: %v", err)
+	}
+	var replicated model.ResourceDocument
+	json.Unmarshal(j, &replicated)
+
+	n.Partition("s1", "s2")
+
+	for _, s := range []*MemoryStore{s1, s2} {
+		d := replicated
+		d.Operations = []model.Operation{{RequestId: s.site}}
+		err := s.Put(ctx, "res", d)
+		if err != nil {
+			t.Fatalf("Couldn't update on %s: %v", s.site, err)
+		}
+	}
+
+	err = s1.Put(ctx, "res", replicated)
+	if err != ErrConflict {
+		t.Fatalf("Expected conflict when updating an old revision, got %v", err)
+	}
+
+	n.Heal("s1", "s2")
+
+	var d1, d2 model.ResourceDocument
+	j1, _ := s1.Get(ctx, "res")
+	j2, _ := s2.Get(ctx, "res")
+	json.Unmarshal(j1, &d1)
+	json.Unmarshal(j2, &d2)
+
+	if d1.Rev != d2.Rev {
+		t.Fatalf("Winners differ: %s vs %s", d1.Rev, d2.Rev)
+	}
+	if len(d1.Conflicts) != 1 || len(d2.Conflicts) != 1 || d1.Conflicts[0] != d2.Conflicts[0] {
+		t.Fatalf("Expected the same single conflict, got %v and %v", d1.Conflicts, d2.Conflicts)
+	}
+
+	err = s1.Delete(ctx, "res", d1.Conflicts[0])
+	if err != nil {
+		t.Fatalf("Couldn't delete conflict: %v", err)
+	}
+	j2, _ = s2.Get(ctx, "res")
+	d2 = model.ResourceDocument{}
+	json.Unmarshal(j2, &d2)
+	if len(d2.Conflicts) != 0 {
+		t.Fatalf("Conflict deletion wasn't replicated: %v", d2.Conflicts)
+	}
+}
+
+func TestMemoryReplicationSelector(t *testing.T) {
+	ctx := context.Background()
+	n := NewMemoryNetwork()
+	s1 := n.Store("s1")
+	s2 := n.Store("s2")
+	s1.Replicate(ctx, "s2")
+
+	s1.Put(ctx, "for-s2", model.ResourceDocument{Locations: []string{"s1", "s2"}, Type: "RESOURCE"})
+	s1.Put(ctx, "not-for-s2", model.ResourceDocument{Locations: []string{"s1"}, Type: "RESOURCE"})
+
+	if _, err := s2.Get(ctx, "for-s2"); err != nil {
+		t.Fatalf("Expected for-s2 to be replicated: %v", err)
+	}
+	if _, err := s2.Get(ctx, "not-for-s2"); err != ErrNotFound {
+		t.Fatalf("Expected not-for-s2 to stay on s1, got %v", err)
+	}
+
+	docs, err := s2.Query(ctx, "all-by-resourceid", "for-s2", "s2")
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("Expected the resource in the view, got %d docs (%v)", len(docs), err)
+	}
+}
+
+func TestDoWithMemoryStores(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := NewMemoryNetwork()
+	r1 := NewReplicatorWithStore(ctx, "s1", n.Store("s1"), 4)
+	NewReplicatorWithStore(ctx, "s2", n.Store("s2"), 4)
+
+	op := model.Operation{
+		Type:      "set",
+		RequestId: "request",
+		Command:   backends.Command{Command: "echo -n done"},
+		Time:      time.Now(),
+	}
+	replies, err := r1.Do(ctx, []string{"s1", "s2"}, "res", op, model.ResourceConfig{})
+	if err != nil {
+		t.Fatalf("Couldn't do: %v", err)
+	}
+
+	sites := make(map[string]bool)
+	for reply := range replies {
+		if reply.Status != "OK" || reply.Output != "done" {
+			t.Fatalf("Invalid reply from %s: %s %q", reply.Site, reply.Status, reply.Output)
+		}
+		sites[reply.Site] = true
+	}
+	if !sites["s1"] || !sites["s2"] {
+		t.Fatalf("Missing replies, got %v", sites)
+	}
+
+	// The watcher of the replies is gone
+	deadline := time.Now().Add(time.Second)
+	for {
+		r1.w.Lock()
+		left := len(r1.w.watchers)
+		r1.w.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d watchers left after the request", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
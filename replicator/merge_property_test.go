@@ -0,0 +1,415 @@
+package replicator
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"cheops.com/model"
+)
+
+var (
+	mergeSeed       = flag.Int64("merge.seed", 0, "seed for the randomized merge tests, 0 for a random one")
+	mergeIterations = flag.Int("merge.iterations", 500, "number of scenarios generated by the randomized merge tests")
+)
+
+// The operation types used in generated scenarios
+var scenarioTypes = []model.OperationType{"a", "b", "c"}
+
+// relation is how two operation types interact, as seen from the pair
+// (scenarioTypes[i], scenarioTypes[j]) with i <= j
+type relation int
+
+const (
+	// Both are kept, in any order
+	relationCommutative relation = iota
+
+	// Both are kept, i before j
+	relationOrdered
+
+	// Only one is kept
+	relationExclusive
+
+	// Nothing is said in the matrix
+	relationUnspecified
+)
+
+// scenario describes concurrent histories of a resource: operations are
+// applied on a common ancestor, then each site applies its own operations
+// before they all synchronize
+type scenario struct {
+	// relations[i][j] for i <= j
+	relations [][]relation
+
+	// indexes in scenarioTypes
+	ancestor []int
+	sites    [][]int
+}
+
+func (sc scenario) config() model.ResourceConfig {
+	var c model.ResourceConfig
+	for i := range scenarioTypes {
+		for j := i; j < len(scenarioTypes); j++ {
+			a, b := scenarioTypes[i], scenarioTypes[j]
+			switch sc.relations[i][j] {
+			case relationCommutative:
+				c.ResolutionMatrix = append(c.ResolutionMatrix,
+					model.Resolution{Before: a, After: b, Result: model.TakeBothAnyOrder})
+				if a != b {
+					c.ResolutionMatrix = append(c.ResolutionMatrix,
+						model.Resolution{Before: b, After: a, Result: model.TakeBothAnyOrder})
+				}
+			case relationOrdered:
+				c.ResolutionMatrix = append(c.ResolutionMatrix,
+					model.Resolution{Before: a, After: b, Result: model.TakeBothKeepOrder})
+				if a != b {
+					c.ResolutionMatrix = append(c.ResolutionMatrix,
+						model.Resolution{Before: b, After: a, Result: model.TakeBothReverseOrder})
+				}
+			case relationExclusive:
+				c.ResolutionMatrix = append(c.ResolutionMatrix,
+					model.Resolution{Before: a, After: b, Result: model.TakeOne})
+				if a != b {
+					c.ResolutionMatrix = append(c.ResolutionMatrix,
+						model.Resolution{Before: b, After: a, Result: model.TakeOne})
+				}
+			}
+		}
+	}
+	return c
+}
+
+// blocks returns the document of each site, as they are before synchronization
+func (sc scenario) blocks() []model.ResourceDocument {
+	config := sc.config()
+
+	var ancestor []model.Operation
+	for i, t := range sc.ancestor {
+		op := model.Operation{
+			Type:      scenarioTypes[t],
+			RequestId: fmt.Sprintf("%s-0-%d", scenarioTypes[t], i),
+		}
+		ancestor = decideOperationsToKeep(config, ancestor, op)
+	}
+
+	docs := make([]model.ResourceDocument, 0, len(sc.sites))
+	for s, site := range sc.sites {
+		ops := append([]model.Operation{}, ancestor...)
+		for i, t := range site {
+			op := model.Operation{
+				Type:      scenarioTypes[t],
+				RequestId: fmt.Sprintf("%s-%d-%d", scenarioTypes[t], s+1, i),
+			}
+			ops = decideOperationsToKeep(config, ops, op)
+		}
+		docs = append(docs, model.ResourceDocument{
+			Id:         "resource",
+			Operations: ops,
+			Config:     config,
+			Type:       "RESOURCE",
+		})
+	}
+	return docs
+}
+
+func (sc scenario) String() string {
+	var b strings.Builder
+	config := sc.config()
+	for _, r := range config.ResolutionMatrix {
+		fmt.Fprintf(&b, "  %s -> %s: %s\n", r.Before, r.After, r.Result)
+	}
+	for i, doc := range sc.blocks() {
+		fmt.Fprintf(&b, "  site %d: %s\n", i+1, logops(doc.Operations))
+	}
+	return b.String()
+}
+
+func generateScenario(rnd *rand.Rand) scenario {
+	sc := scenario{
+		relations: make([][]relation, len(scenarioTypes)),
+	}
+	for i := range scenarioTypes {
+		sc.relations[i] = make([]relation, len(scenarioTypes))
+		for j := i; j < len(scenarioTypes); j++ {
+			sc.relations[i][j] = relation(rnd.Intn(4))
+			if i == j && sc.relations[i][j] == relationOrdered {
+				sc.relations[i][j] = relationCommutative
+			}
+		}
+	}
+
+	randomOps := func(min, max int) []int {
+		ops := make([]int, min+rnd.Intn(max-min+1))
+		for i := range ops {
+			ops[i] = rnd.Intn(len(scenarioTypes))
+		}
+		return ops
+	}
+
+	sc.ancestor = randomOps(0, 3)
+	sc.sites = make([][]int, 2+rnd.Intn(3))
+	for i := range sc.sites {
+		sc.sites[i] = randomOps(1, 3)
+	}
+	return sc
+}
+
+// shrink returns smaller variants of the scenario
+func (sc scenario) shrink() []scenario {
+	copyScenario := func() scenario {
+		c := scenario{
+			relations: make([][]relation, len(sc.relations)),
+			ancestor:  append([]int{}, sc.ancestor...),
+			sites:     make([][]int, len(sc.sites)),
+		}
+		for i := range sc.relations {
+			c.relations[i] = append([]relation{}, sc.relations[i]...)
+		}
+		for i := range sc.sites {
+			c.sites[i] = append([]int{}, sc.sites[i]...)
+		}
+		return c
+	}
+
+	ret := make([]scenario, 0)
+
+	if len(sc.sites) > 2 {
+		for i := range sc.sites {
+			c := copyScenario()
+			c.sites = append(c.sites[:i], c.sites[i+1:]...)
+			ret = append(ret, c)
+		}
+	}
+
+	for i := range sc.ancestor {
+		c := copyScenario()
+		c.ancestor = append(c.ancestor[:i], c.ancestor[i+1:]...)
+		ret = append(ret, c)
+	}
+
+	for s := range sc.sites {
+		if len(sc.sites[s]) == 1 {
+			continue
+		}
+		for i := range sc.sites[s] {
+			c := copyScenario()
+			c.sites[s] = append(c.sites[s][:i], c.sites[s][i+1:]...)
+			ret = append(ret, c)
+		}
+	}
+
+	// Use lower types, and simpler relations
+	for s := range sc.sites {
+		for i, t := range sc.sites[s] {
+			if t > 0 {
+				c := copyScenario()
+				c.sites[s][i] = 0
+				ret = append(ret, c)
+			}
+		}
+	}
+	for i := range sc.relations {
+		for j := i; j < len(sc.relations); j++ {
+			if sc.relations[i][j] != relationCommutative {
+				c := copyScenario()
+				c.relations[i][j] = relationCommutative
+				ret = append(ret, c)
+			}
+		}
+	}
+
+	return ret
+}
+
+// mergeProperty checks a property of resolveMerge on a scenario. It returns
+// an error describing the violation, if any.
+type mergeProperty func(sc scenario) error
+
+// safeMerge runs resolveMerge, turning a panic into an error
+func safeMerge(main model.ResourceDocument, conflicts []model.ResourceDocument) (resolved model.ResourceDocument, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return resolveMerge(main, conflicts)
+}
+
+// mergeWith merges the blocks with the one at index winner as the main
+// document and the others in the given order
+func mergeWith(blocks []model.ResourceDocument, winner int, order []int) (model.ResourceDocument, error) {
+	conflicts := make([]model.ResourceDocument, 0, len(order))
+	for _, i := range order {
+		conflicts = append(conflicts, blocks[i])
+	}
+	return safeMerge(blocks[winner], conflicts)
+}
+
+// others returns the indexes of the blocks that are not the winner
+func others(n, winner int) []int {
+	ret := make([]int, 0, n-1)
+	for i := 0; i < n; i++ {
+		if i != winner {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+func reversed(a []int) []int {
+	ret := make([]int, len(a))
+	for i := range a {
+		ret[len(a)-1-i] = a[i]
+	}
+	return ret
+}
+
+// propDeterministic: merging the same input twice gives the same result
+func propDeterministic(sc scenario) error {
+	blocks := sc.blocks()
+	first, err := mergeWith(blocks, 0, others(len(blocks), 0))
+	if err != nil {
+		return err
+	}
+	second, err := mergeWith(sc.blocks(), 0, others(len(blocks), 0))
+	if err != nil {
+		return err
+	}
+	if logops(first.Operations) != logops(second.Operations) {
+		return fmt.Errorf("got %s then %s", logops(first.Operations), logops(second.Operations))
+	}
+	return nil
+}
+
+// propWinnerIndependent: the result doesn't depend on which revision is the
+// winner, nor on the order of the conflicts
+func propWinnerIndependent(sc scenario) error {
+	blocks := sc.blocks()
+	reference, err := mergeWith(blocks, 0, others(len(blocks), 0))
+	if err != nil {
+		return err
+	}
+	for winner := range blocks {
+		for _, order := range [][]int{others(len(blocks), winner), reversed(others(len(blocks), winner))} {
+			resolved, err := mergeWith(blocks, winner, order)
+			if err != nil {
+				return err
+			}
+			if logops(resolved.Operations) != logops(reference.Operations) {
+				return fmt.Errorf("winner site 1 gives %s, winner site %d with conflicts %v gives %s",
+					logops(reference.Operations), winner+1, order, logops(resolved.Operations))
+			}
+		}
+	}
+	return nil
+}
+
+// propKeepsOperations: an operation is only dropped if it is exclusive with
+// an operation of another block, and no operation is duplicated
+func propKeepsOperations(sc scenario) error {
+	blocks := sc.blocks()
+	config := sc.config()
+
+	exclusive := func(a, b model.OperationType) bool {
+		for _, r := range config.ResolutionMatrix {
+			if r.Before == a && r.After == b {
+				return r.Result == model.TakeOne
+			}
+		}
+		return false
+	}
+
+	for winner := range blocks {
+		resolved, err := mergeWith(blocks, winner, others(len(blocks), winner))
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]bool)
+		for _, op := range resolved.Operations {
+			if seen[op.RequestId] {
+				return fmt.Errorf("%s is duplicated in %s", op.RequestId, logops(resolved.Operations))
+			}
+			seen[op.RequestId] = true
+		}
+
+		for i, block := range blocks {
+			for _, op := range block.Operations {
+				if seen[op.RequestId] {
+					continue
+				}
+				droppable := false
+				for j, other := range blocks {
+					if i == j {
+						continue
+					}
+					for _, otherOp := range other.Operations {
+						if otherOp.RequestId != op.RequestId && (exclusive(op.Type, otherOp.Type) || exclusive(otherOp.Type, op.Type)) {
+							droppable = true
+						}
+					}
+				}
+				if !droppable {
+					return fmt.Errorf("%s was dropped with winner site %d: %s", op.RequestId, winner+1, logops(resolved.Operations))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkMergeProperty generates scenarios until one violates the property,
+// then shrinks it to a minimal counterexample. It returns the description of
+// the counterexample, or an empty string if none was found.
+func checkMergeProperty(t *testing.T, prop mergeProperty) string {
+	seed := *mergeSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < *mergeIterations; i++ {
+		sc := generateScenario(rnd)
+		err := prop(sc)
+		if err == nil {
+			continue
+		}
+
+		shrinks := 0
+	shrinking:
+		for {
+			for _, smaller := range sc.shrink() {
+				if e := prop(smaller); e != nil {
+					sc, err = smaller, e
+					shrinks++
+					continue shrinking
+				}
+			}
+			break
+		}
+
+		return fmt.Sprintf("seed %d, scenario %d, shrunk %d times: %v\n%v", seed, i, shrinks, err, sc)
+	}
+	return ""
+}
+
+func TestMergeDeterministic(t *testing.T) {
+	if failure := checkMergeProperty(t, propDeterministic); failure != "" {
+		t.Fatalf("resolveMerge is not deterministic: %s", failure)
+	}
+}
+
+func TestMergeWinnerIndependent(t *testing.T) {
+	if failure := checkMergeProperty(t, propWinnerIndependent); failure != "" {
+		t.Fatalf("resolveMerge depends on the winner: %s", failure)
+	}
+}
+
+func TestMergeKeepsOperations(t *testing.T) {
+	if failure := checkMergeProperty(t, propKeepsOperations); failure != "" {
+		t.Fatalf("resolveMerge loses operations: %s", failure)
+	}
+}
@@ -0,0 +1,58 @@
+package replicator
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics tell what a Replicator did since it started, and what it is doing
+type Metrics struct {
+	Compaction CompactionMetrics `json:"compaction"`
+	Workers    WorkersMetrics    `json:"workers"`
+}
+
+// CompactionMetrics tells how much garbage the compactor removed
+type CompactionMetrics struct {
+	Runs    int       `json:"runs"`
+	LastRun time.Time `json:"lastRun"`
+	Errors  int       `json:"errors"`
+
+	// Operations before a snapshot that every location ran
+	OperationsDropped int `json:"operationsDropped"`
+
+	// Replies of operations that were superseded
+	RepliesRemoved int `json:"repliesRemoved"`
+
+	// Bytes reclaimed by the compaction of the store, as estimated before
+	// running it
+	BytesReclaimed int64 `json:"bytesReclaimed"`
+}
+
+// WorkersMetrics tells how busy the workers that run requests are
+type WorkersMetrics struct {
+	Workers int `json:"workers"`
+
+	// Resources being handled
+	Running int `json:"running"`
+
+	// Changes waiting for a worker
+	Queued int `json:"queued"`
+
+	// Operations waiting for the backoff before their next attempt
+	Delayed int `json:"delayed"`
+}
+
+type metrics struct {
+	sync.Mutex
+	Metrics
+}
+
+// Metrics returns the current value of the counters
+func (r *Replicator) Metrics() Metrics {
+	r.metrics.Lock()
+	m := r.metrics.Metrics
+	r.metrics.Unlock()
+
+	m.Workers = r.workers.metrics()
+	return m
+}
@@ -0,0 +1,133 @@
+package replicator
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pool runs functions on a fixed number of workers. Functions with the same
+// key run one after the other, in the order they were submitted; functions
+// with different keys run at the same time.
+type pool struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	workers int
+
+	// key -> functions waiting to run. A key is there as long as it has
+	// functions waiting or running
+	queues map[string][]func()
+
+	// keys that have functions waiting and none running, in order
+	ready []string
+
+	running int
+	queued  int
+
+	// functions waiting for their delay before being submitted
+	delayed int
+}
+
+func newPool(ctx context.Context, workers int) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &pool{
+		workers: workers,
+		queues:  make(map[string][]func()),
+		ready:   make([]string, 0),
+	}
+	p.cond = sync.NewCond(p)
+
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		p.Lock()
+		p.cond.Broadcast()
+		p.Unlock()
+	}()
+	return p
+}
+
+// submit queues f after the other functions of the same key
+func (p *pool) submit(key string, f func()) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.queues[key]; !ok {
+		p.ready = append(p.ready, key)
+	}
+	p.queues[key] = append(p.queues[key], f)
+	p.queued++
+	p.cond.Signal()
+}
+
+// submitAfter submits f once delay has passed, without holding a worker in
+// the meantime
+func (p *pool) submitAfter(key string, delay time.Duration, f func()) {
+	p.Lock()
+	p.delayed++
+	p.Unlock()
+
+	time.AfterFunc(delay, func() {
+		p.Lock()
+		p.delayed--
+		p.Unlock()
+		p.submit(key, f)
+	})
+}
+
+func (p *pool) work(ctx context.Context) {
+	for {
+		p.Lock()
+		for len(p.ready) == 0 && ctx.Err() == nil {
+			p.cond.Wait()
+		}
+		if ctx.Err() != nil {
+			p.Unlock()
+			return
+		}
+
+		key := p.ready[0]
+		p.ready = p.ready[1:]
+		f := p.queues[key][0]
+		p.queues[key] = p.queues[key][1:]
+		p.queued--
+		p.running++
+		p.Unlock()
+
+		f()
+
+		p.Lock()
+		p.running--
+		if len(p.queues[key]) > 0 {
+			// Let other keys go first
+			p.ready = append(p.ready, key)
+			p.cond.Signal()
+		} else {
+			delete(p.queues, key)
+		}
+		p.Unlock()
+	}
+}
+
+// idle returns true if nothing is running or waiting
+func (p *pool) idle() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.running == 0 && p.queued == 0 && p.delayed == 0
+}
+
+func (p *pool) metrics() WorkersMetrics {
+	p.Lock()
+	defer p.Unlock()
+	return WorkersMetrics{
+		Workers: p.workers,
+		Running: p.running,
+		Queued:  p.queued,
+		Delayed: p.delayed,
+	}
+}
@@ -0,0 +1,117 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPool(ctx, 4)
+
+	var lock sync.Mutex
+	running := make(map[string]bool)
+	order := make(map[string][]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("res%d", i%2)
+		i := i
+		wg.Add(1)
+		p.submit(key, func() {
+			defer wg.Done()
+			lock.Lock()
+			if running[key] {
+				t.Errorf("Two functions of %s run at the same time", key)
+			}
+			running[key] = true
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			running[key] = false
+			order[key] = append(order[key], i)
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for key, indexes := range order {
+		for j := 1; j < len(indexes); j++ {
+			if indexes[j] < indexes[j-1] {
+				t.Fatalf("Functions of %s didn't run in order: %v", key, indexes)
+			}
+		}
+	}
+	if m := p.metrics(); m.Running != 0 || m.Queued != 0 || !p.idle() {
+		t.Fatalf("Expected an idle pool, got %#v", m)
+	}
+}
+
+func TestPoolParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPool(ctx, 2)
+
+	blocked := make(chan struct{})
+	p.submit("slow", func() { <-blocked })
+	p.submit("slow", func() {})
+
+	ran := make(chan string, 1)
+	p.submit("fast", func() { ran <- "fast" })
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("A slow resource blocks the others")
+	}
+
+	// The slow resource runs with one more change waiting
+	deadline := time.Now().Add(5 * time.Second)
+	for m := p.metrics(); m.Workers != 2 || m.Running != 1 || m.Queued != 1; m = p.metrics() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected metrics: %#v", m)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(blocked)
+
+	for !p.idle() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool didn't finish: %#v", p.metrics())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolSubmitAfter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPool(ctx, 1)
+
+	ran := make(chan struct{})
+	p.submitAfter("res", 50*time.Millisecond, func() { close(ran) })
+	if m := p.metrics(); m.Delayed != 1 || m.Running != 0 || p.idle() {
+		t.Fatalf("Expected a delayed function, got %#v", m)
+	}
+
+	// The worker is free meanwhile
+	other := make(chan struct{})
+	p.submit("other", func() { close(other) })
+	select {
+	case <-other:
+	case <-ran:
+		t.Fatalf("The delayed function ran first")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("A delayed function holds the worker")
+	}
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The delayed function never ran")
+	}
+}
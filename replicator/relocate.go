@@ -0,0 +1,232 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"cheops.com/model"
+)
+
+// Relocate changes the locations of an existing resource. New sites replay
+// the current operations; removed sites run the teardown command of the
+// request, or the cleanup of the resource config if the request doesn't have
+// any.
+//
+// The output is a chan of the replies to the teardown from the removed sites,
+// as they arrive. After a timeout or all replies are sent, the chan is closed
+func (r *Replicator) Relocate(ctx context.Context, id string, sites []string, request model.Operation) (replies chan model.ReplyDocument, err error) {
+	if len(sites) == 0 {
+		return nil, ErrInvalidRequest("a resource needs at least one location")
+	}
+
+	repliesCtx, cancel := context.WithCancel(ctx)
+	repliesChan := make(chan model.ReplyDocument)
+	r.watchReplies(repliesCtx, request.RequestId, repliesChan)
+
+	doc, err := r.getResourceDocFor(ctx, id)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if doc.Id == "" {
+		cancel()
+		return nil, ErrDoesNotExist
+	}
+	if doc.Tombstone != nil {
+		cancel()
+		return nil, ErrInvalidRequest("the resource is being deleted")
+	}
+
+	isNew := make(map[string]bool)
+	for _, site := range sites {
+		isNew[site] = true
+	}
+	removed := make([]string, 0)
+	for _, location := range doc.Locations {
+		if !isNew[location] {
+			removed = append(removed, location)
+		}
+	}
+
+	if request.Command.IsEmpty() {
+		request.Command = r.cleanup(doc.Config)
+	}
+
+	doc.Relocation = &request
+	doc.Locations = sites
+	for _, site := range removed {
+		doc.Leaving = append(doc.Leaving, model.Departure{
+			Site:      site,
+			RequestId: request.RequestId,
+			Time:      request.Time,
+			Teardown:  request.Command,
+			Identity:  request.Identity,
+		})
+	}
+	doc.Leaving = mergeDepartures(doc, []model.ResourceDocument{doc})
+	log.Printf("Relocation request: resourceId=%v requestId=%v locations=%v\n", doc.Id, request.RequestId, sites)
+
+	err = r.s.Put(ctx, id, doc)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Couldn't send relocation for %s: %v", id, err)
+	}
+
+	leaving := doc
+	leaving.Locations = removed
+	return r.gatherReplies(ctx, leaving, request, repliesChan, cancel), nil
+}
+
+// departure returns the departure of this site that hasn't been done yet, if any
+func (r *Replicator) departure(d model.ResourceDocument) *model.Departure {
+	for _, departure := range d.Leaving {
+		if departure.Site == r.site && !departure.Done {
+			return &departure
+		}
+	}
+	return nil
+}
+
+// leave runs the teardown on this site, if it wasn't already done
+func (r *Replicator) leave(ctx context.Context, d model.ResourceDocument, departure model.Departure) {
+	allDocs, err := r.getAllDocsFor(ctx, d.Id, r.site)
+	if err != nil {
+		log.Printf("Couldn't get docs for id: %v\n", err)
+		return
+	}
+	for _, doc := range allDocs {
+		var reply model.ReplyDocument
+		err := json.Unmarshal(doc, &reply)
+		if err == nil && reply.Type == "REPLY" && reply.RequestId == departure.RequestId {
+			return
+		}
+	}
+
+	reply := model.ReplyDocument{
+		Locations:  d.Locations,
+		Site:       r.site,
+		RequestId:  departure.RequestId,
+		ResourceId: d.Id,
+		Status:     "OK",
+		Cmd: model.Cmd{
+			Input: departure.Teardown.Command,
+		},
+		Identity: departure.Identity,
+		Type:     "REPLY",
+	}
+	if !departure.Teardown.IsEmpty() {
+		r.execute(ctx, departure.Teardown, time.Duration(d.Config.Timeout), &reply)
+	}
+	reply.ExecutionTime = time.Now()
+
+	err = r.s.Post(ctx, reply)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Left resource=%s status=%s\n", d.Id, reply.Status)
+}
+
+// completeDepartures marks the departures whose teardown was run as done
+func (r *Replicator) completeDepartures(ctx context.Context, id string) {
+	j, err := r.s.Get(ctx, id)
+	if err != nil {
+		return
+	}
+	var d model.ResourceDocument
+	err = json.Unmarshal(j, &d)
+	if err != nil || len(d.Conflicts) > 0 {
+		return
+	}
+
+	done := make([]string, 0)
+	for i, departure := range d.Leaving {
+		if departure.Done {
+			continue
+		}
+		replies, err := r.getAllDocsFor(ctx, id, departure.Site)
+		if err != nil {
+			log.Printf("Couldn't get docs for id: %v\n", err)
+			return
+		}
+		for _, doc := range replies {
+			var reply model.ReplyDocument
+			err := json.Unmarshal(doc, &reply)
+			if err == nil && reply.Type == "REPLY" && reply.Site == departure.Site && reply.RequestId == departure.RequestId {
+				d.Leaving[i].Done = true
+				done = append(done, departure.Site)
+			}
+		}
+	}
+	if len(done) == 0 {
+		return
+	}
+
+	err = r.s.Put(ctx, id, d)
+	if err != nil {
+		// Someone else did it, or will do it with the next change
+		log.Printf("Couldn't complete departures for %s: %v\n", id, err)
+		return
+	}
+	log.Printf("Departures done: resource=%s sites=%v\n", id, done)
+}
+
+// retireReplication removes the replication to site if no resource is
+// destined to it anymore
+func (r *Replicator) retireReplication(ctx context.Context, site string) {
+	jobs, err := r.s.Replications(ctx)
+	if err != nil {
+		log.Printf("Couldn't get existing replications: %v\n", err)
+		return
+	}
+	if _, ok := jobs[site]; !ok {
+		return
+	}
+
+	docs, err := r.s.Query(ctx, "by-location", site)
+	if err != nil {
+		log.Printf("Couldn't get resources for %s: %v\n", site, err)
+		return
+	}
+	if len(docs) > 0 {
+		return
+	}
+	err = r.s.Unreplicate(ctx, site)
+	if err != nil {
+		log.Printf("Couldn't remove replication to %s: %v\n", site, err)
+		return
+	}
+	r.publish(Event{Type: EventReplication, Site: site})
+}
+
+// repliesSinceDeparture drops the replies of site from before its last
+// departure
+func repliesSinceDeparture(d model.ResourceDocument, site string, replies []model.ReplyDocument) []model.ReplyDocument {
+	departures := make(map[string]bool)
+	for _, departure := range d.Leaving {
+		if departure.Site == site {
+			departures[departure.RequestId] = true
+		}
+	}
+
+	var left time.Time
+	for _, reply := range replies {
+		if reply.Site == site && departures[reply.RequestId] && reply.ExecutionTime.After(left) {
+			left = reply.ExecutionTime
+		}
+	}
+	if left.IsZero() {
+		return replies
+	}
+
+	ret := make([]model.ReplyDocument, 0)
+	for _, reply := range replies {
+		if reply.Site != site || reply.ExecutionTime.After(left) {
+			ret = append(ret, reply)
+		}
+	}
+	return ret
+}
@@ -1,8 +1,10 @@
 package replicator
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"cheops.com/model"
 )
@@ -64,11 +66,11 @@ func TestMerge(t *testing.T) {
 			expected: model.ResourceDocument{
 				Operations: []model.Operation{
 					{
-						Type:      model.OperationType("inc"),
-						RequestId: "inc",
-					}, {
 						Type:      model.OperationType("dec"),
 						RequestId: "dec",
+					}, {
+						Type:      model.OperationType("inc"),
+						RequestId: "inc",
 					},
 				},
 			},
@@ -208,10 +210,10 @@ func TestMerge(t *testing.T) {
 						RequestId: "inc1",
 					}, {
 						Type:      model.OperationType("inc"),
-						RequestId: "inc-main",
+						RequestId: "inc-conflict",
 					}, {
 						Type:      model.OperationType("inc"),
-						RequestId: "inc-conflict",
+						RequestId: "inc-main",
 					},
 				},
 			},
@@ -245,7 +247,7 @@ func TestMerge(t *testing.T) {
 				Operations: []model.Operation{
 					{
 						Type:      model.OperationType("set"),
-						RequestId: "set-0",
+						RequestId: "set-1",
 					}, {
 						Type:      model.OperationType("inc"),
 						RequestId: "inc1",
@@ -319,6 +321,179 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestMergeThreeSites(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := func(typ, id string, seconds int) model.Operation {
+		return model.Operation{
+			Type:      model.OperationType(typ),
+			RequestId: id,
+			Time:      base.Add(time.Duration(seconds) * time.Second),
+		}
+	}
+
+	vectors := []struct {
+		blocks   [][]model.Operation
+		expected []string
+	}{
+		{
+			// All sites append to the same block
+			blocks: [][]model.Operation{
+				{op("set", "set", 0), op("inc", "inc-1", 1)},
+				{op("set", "set", 0), op("inc", "inc-2", 2)},
+				{op("set", "set", 0), op("dec", "dec-3", 3)},
+			},
+			expected: []string{"set", "dec-3", "inc-1", "inc-2"},
+		},
+		{
+			// One site replaces the block, the most recent set wins
+			blocks: [][]model.Operation{
+				{op("set", "set", 0), op("inc", "inc-1", 1)},
+				{op("set", "set-2", 2)},
+				{op("set", "set-3", 3), op("dec", "dec-3", 4)},
+			},
+			expected: []string{"set-3", "inc-1", "dec-3"},
+		},
+		{
+			// Heads are ordered by time, a set is put before an inc
+			blocks: [][]model.Operation{
+				{op("inc", "inc-1", 1)},
+				{op("set", "set-2", 2)},
+				{op("dec", "dec-3", 3)},
+			},
+			expected: []string{"set-2", "inc-1", "dec-3"},
+		},
+		{
+			// Empty blocks are ignored
+			blocks: [][]model.Operation{
+				{},
+				{op("inc", "inc-2", 2)},
+				{op("inc", "inc-3", 3)},
+			},
+			expected: []string{"inc-2", "inc-3"},
+		},
+	}
+
+	permutations := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+
+	for i, v := range vectors {
+		for _, p := range permutations {
+			docs := make([]model.ResourceDocument, 0)
+			for _, j := range p {
+				docs = append(docs, model.ResourceDocument{Operations: v.blocks[j], Config: counterConfig})
+			}
+
+			resolved, err := resolveMerge(docs[0], docs[1:])
+			if err != nil {
+				t.Fatalf("vector %d: got err: %v", i, err)
+			}
+			if logops(resolved.Operations) != "["+strings.Join(v.expected, ",")+"]" {
+				t.Fatalf("vector %d, order %v: got %s want %v", i, p, logops(resolved.Operations), v.expected)
+			}
+		}
+	}
+}
+
+func TestMergeNoOperations(t *testing.T) {
+	resolved, err := resolveMerge(model.ResourceDocument{}, []model.ResourceDocument{{}, {}})
+	if err != nil {
+		t.Fatalf("got err: %v", err)
+	}
+	if len(resolved.Operations) != 0 {
+		t.Fatalf("Expected no operations, got %s", logops(resolved.Operations))
+	}
+}
+
+func TestMergeTombstone(t *testing.T) {
+	tombstone := &model.Operation{RequestId: "delete"}
+	main := model.ResourceDocument{
+		Operations: []model.Operation{{Type: "inc", RequestId: "inc"}},
+	}
+	conflict := model.ResourceDocument{
+		Operations: []model.Operation{{Type: "dec", RequestId: "dec"}},
+		Tombstone:  tombstone,
+	}
+
+	for _, docs := range [][]model.ResourceDocument{{main, conflict}, {conflict, main}} {
+		resolved, err := resolveMerge(docs[0], docs[1:])
+		if err != nil {
+			t.Fatalf("got err: %v", err)
+		}
+		if resolved.Tombstone == nil || resolved.Tombstone.RequestId != "delete" {
+			t.Fatalf("Expected the deletion to win, got %#v", resolved.Tombstone)
+		}
+	}
+}
+
+func TestMergeSnapshot(t *testing.T) {
+	config := model.ResourceConfig{Snapshots: []model.OperationType{"snap"}}
+	truncated := model.ResourceDocument{
+		Operations: []model.Operation{
+			{Type: "snap", RequestId: "snap"},
+			{Type: "inc", RequestId: "inc3"},
+		},
+		Config: config,
+	}
+	old := model.ResourceDocument{
+		Operations: []model.Operation{
+			{Type: "inc", RequestId: "inc1"},
+			{Type: "inc", RequestId: "inc2"},
+			{Type: "snap", RequestId: "snap"},
+			{Type: "inc", RequestId: "inc4"},
+		},
+		Config: config,
+	}
+
+	for _, docs := range [][]model.ResourceDocument{{truncated, old}, {old, truncated}} {
+		resolved, err := resolveMerge(docs[0], docs[1:])
+		if err != nil {
+			t.Fatalf("got err: %v", err)
+		}
+		if ops := logops(resolved.Operations); ops != "[snap,inc3,inc4]" {
+			t.Fatalf("Expected the operations before the snapshot to stay dropped, got %s", ops)
+		}
+	}
+}
+
+func TestMergeRelocation(t *testing.T) {
+	at := func(seconds int) time.Time {
+		return time.Date(2024, 1, 1, 0, 0, seconds, 0, time.UTC)
+	}
+	original := model.ResourceDocument{
+		Locations:  []string{"a", "b"},
+		Operations: []model.Operation{{Type: "inc", RequestId: "inc"}},
+	}
+	first := model.ResourceDocument{
+		Locations:  []string{"a", "c"},
+		Operations: []model.Operation{{Type: "inc", RequestId: "inc"}},
+		Relocation: &model.Operation{RequestId: "first", Time: at(1)},
+		Leaving:    []model.Departure{{Site: "b", RequestId: "first", Time: at(1)}},
+	}
+	second := model.ResourceDocument{
+		Locations:  []string{"a", "d"},
+		Operations: []model.Operation{{Type: "inc", RequestId: "inc"}},
+		Relocation: &model.Operation{RequestId: "second", Time: at(2)},
+		Leaving:    []model.Departure{{Site: "b", RequestId: "second", Time: at(2), Done: true}},
+	}
+
+	for _, docs := range [][]model.ResourceDocument{{original, first, second}, {second, original, first}, {first, second, original}} {
+		resolved, err := resolveMerge(docs[0], docs[1:])
+		if err != nil {
+			t.Fatalf("got err: %v", err)
+		}
+		if strings.Join(resolved.Locations, ",") != "a,d" || resolved.Relocation.RequestId != "second" {
+			t.Fatalf("Expected the most recent relocation to win, got %v", resolved.Locations)
+		}
+
+		leaving := make([]string, 0)
+		for _, d := range resolved.Leaving {
+			leaving = append(leaving, fmt.Sprintf("%s/%s/%v", d.Site, d.RequestId, d.Done))
+		}
+		if strings.Join(leaving, " ") != "b/second/true c/second/false" {
+			t.Fatalf("Invalid departures: %v", leaving)
+		}
+	}
+}
+
 type findTestVector struct {
 	ops      []model.Operation
 	replies  []model.ReplyDocument
@@ -438,6 +613,52 @@ func TestFindOperations(t *testing.T) {
 					Before: "inc", After: "inc", Result: model.TakeBothAnyOrder,
 				}},
 			},
+		}, {
+			// A new site starts from the snapshot
+			ops: []model.Operation{
+				{RequestId: "inc1", Type: "inc"},
+				{RequestId: "inc2", Type: "inc"},
+				{RequestId: "snap", Type: "snap"},
+				{RequestId: "inc3", Type: "inc"},
+			},
+			replies: []model.ReplyDocument{},
+			expected: []model.Operation{
+				{RequestId: "snap"},
+				{RequestId: "inc3"},
+			},
+			config: model.ResourceConfig{
+				Snapshots: []model.OperationType{"snap"},
+			},
+		}, {
+			// A failure is attempted again while the policy allows it
+			ops: []model.Operation{
+				{RequestId: "set", Type: "set"},
+				{RequestId: "inc1", Type: "inc"},
+			},
+			replies: []model.ReplyDocument{
+				{RequestId: "set", Status: "OK", Attempt: 1},
+				{RequestId: "inc1", Status: "KO", Attempt: 1},
+			},
+			expected: []model.Operation{
+				{RequestId: "inc1"},
+			},
+			config: model.ResourceConfig{
+				RetryPolicies: []model.RetryPolicy{{Type: "inc", MaxAttempts: 2}},
+			},
+		}, {
+			ops: []model.Operation{
+				{RequestId: "set", Type: "set"},
+				{RequestId: "inc1", Type: "inc"},
+			},
+			replies: []model.ReplyDocument{
+				{RequestId: "set", Status: "OK", Attempt: 1},
+				{RequestId: "inc1", Status: "KO", Attempt: 1},
+				{RequestId: "inc1", Status: "KO", Attempt: 2, ExecutionTime: time.Now()},
+			},
+			expected: []model.Operation{},
+			config: model.ResourceConfig{
+				RetryPolicies: []model.RetryPolicy{{Type: "inc", MaxAttempts: 2}},
+			},
 		},
 	}
 
@@ -0,0 +1,53 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cheops.com/model"
+)
+
+// Count returns the number of resources known by this node
+func (r *Replicator) CountResources() (int, error) {
+	keys, err := r.s.Groups(context.Background(), "all-by-resourceid", 1)
+	if err != nil {
+		return 0, fmt.Errorf("Error running by-resource view: %v\n", err)
+	}
+	return len(keys), nil
+}
+
+func (r *Replicator) GetOrderedReplies(id string) (map[string][]model.ReplyDocument, error) {
+	docs, err := r.s.Query(context.Background(), "last-reply", r.site, id)
+	if err != nil {
+		return nil, fmt.Errorf("Error running last-reply view: %v\n", err)
+	}
+
+	m := make(map[string][]model.ReplyDocument)
+	for _, doc := range docs {
+		var d model.ReplyDocument
+		err := json.Unmarshal(doc, &d)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid resource document: %v\n", err)
+		}
+		if _, ok := m[d.ResourceId]; !ok {
+			m[d.ResourceId] = make([]model.ReplyDocument, 0)
+		}
+		m[d.ResourceId] = append(m[d.ResourceId], d)
+	}
+
+	return m, nil
+}
+
+// Locations returns the sites of the resource as this node knows them. If the
+// resource doesn't exist here, ErrDoesNotExist is returned
+func (r *Replicator) Locations(ctx context.Context, id string) ([]string, error) {
+	doc, err := r.getResourceDocFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Id == "" {
+		return nil, ErrDoesNotExist
+	}
+	return doc.Locations, nil
+}
@@ -0,0 +1,53 @@
+package replicator
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// runningCommands are the commands running on this site, so that they can be
+// canceled
+type runningCommands struct {
+	sync.Mutex
+
+	// request id -> cancel of the command
+	cancels map[string]context.CancelFunc
+}
+
+func newRunningCommands() *runningCommands {
+	return &runningCommands{
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// start returns the context to run the command of the request with, and the
+// function to call once it is done
+func (rc *runningCommands) start(ctx context.Context, requestId string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	rc.Lock()
+	rc.cancels[requestId] = cancel
+	rc.Unlock()
+
+	return ctx, func() {
+		rc.Lock()
+		delete(rc.cancels, requestId)
+		rc.Unlock()
+		cancel()
+	}
+}
+
+// Cancel kills the command of the request if it is running on this site. Its
+// reply says it was canceled, and it is not attempted again. If the command
+// isn't running, ErrDoesNotExist is returned
+func (r *Replicator) Cancel(requestId string) error {
+	r.running.Lock()
+	cancel, ok := r.running.cancels[requestId]
+	r.running.Unlock()
+	if !ok {
+		return ErrDoesNotExist
+	}
+	log.Printf("Canceling request=%s\n", requestId)
+	cancel()
+	return nil
+}
@@ -0,0 +1,990 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cheops.com/backends"
+	"cheops.com/config"
+	"cheops.com/model"
+)
+
+// simulation runs multiple replicators in the same process, each with its
+// own MemoryStore. Links between sites can be cut and healed to reproduce the
+// scenarios of CONSISTENCY.md.
+type simulation struct {
+	t       *testing.T
+	ctx     context.Context
+	network *MemoryNetwork
+
+	sites       []string
+	replicators map[string]*Replicator
+
+	requests int
+}
+
+func newSimulation(t *testing.T, sites ...string) *simulation {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sim := &simulation{
+		t:           t,
+		ctx:         ctx,
+		network:     NewMemoryNetwork(),
+		sites:       sites,
+		replicators: make(map[string]*Replicator),
+	}
+	for _, site := range sites {
+		sim.replicators[site] = NewReplicatorWithStore(ctx, site, sim.network.Store(site), 4)
+	}
+	return sim
+}
+
+// partition cuts the links between every site of a and every site of b
+func (sim *simulation) partition(a []string, b []string) {
+	for _, sa := range a {
+		for _, sb := range b {
+			sim.network.Partition(sa, sb)
+		}
+	}
+}
+
+// isolate cuts the links between site and all other sites
+func (sim *simulation) isolate(site string) {
+	for _, other := range sim.sites {
+		if other != site {
+			sim.network.Partition(site, other)
+		}
+	}
+}
+
+// healAll restores all links
+func (sim *simulation) healAll() {
+	for _, a := range sim.sites {
+		for _, b := range sim.sites {
+			if a < b {
+				sim.network.Heal(a, b)
+			}
+		}
+	}
+}
+
+// do sends an operation of the given type on the given site and returns its
+// request id. Replies are not waited for, use settle for that.
+func (sim *simulation) do(site, id string, sites []string, typ, command string, config model.ResourceConfig) string {
+	sim.requests++
+	op := model.Operation{
+		Type:      model.OperationType(typ),
+		RequestId: fmt.Sprintf("%s-request-%d", site, sim.requests),
+		Command:   backends.Command{Command: command},
+		Time:      time.Now(),
+		Identity:  "tester",
+	}
+	replies, err := sim.replicators[site].Do(sim.ctx, sites, id, op, config)
+	if err != nil {
+		sim.t.Fatalf("Couldn't do %s on %s: %v", op.RequestId, site, err)
+	}
+	go func() {
+		for range replies {
+		}
+	}()
+	return op.RequestId
+}
+
+// del deletes the resource from the given site and returns the request id
+// of the deletion
+func (sim *simulation) del(site, id, cleanup string) string {
+	sim.requests++
+	op := model.Operation{
+		RequestId: fmt.Sprintf("%s-request-%d", site, sim.requests),
+		Command:   backends.Command{Command: cleanup},
+		Time:      time.Now(),
+	}
+	replies, err := sim.replicators[site].Delete(sim.ctx, id, op)
+	if err != nil {
+		sim.t.Fatalf("Couldn't delete %s on %s: %v", id, site, err)
+	}
+	go func() {
+		for range replies {
+		}
+	}()
+	return op.RequestId
+}
+
+// relocate changes the locations of the resource from the given site and
+// returns the request id of the relocation
+func (sim *simulation) relocate(site, id string, sites []string, teardown string) string {
+	sim.requests++
+	op := model.Operation{
+		RequestId: fmt.Sprintf("%s-request-%d", site, sim.requests),
+		Command:   backends.Command{Command: teardown},
+		Time:      time.Now(),
+		Identity:  "tester",
+	}
+	replies, err := sim.replicators[site].Relocate(sim.ctx, id, sites, op)
+	if err != nil {
+		sim.t.Fatalf("Couldn't relocate %s on %s: %v", id, site, err)
+	}
+	go func() {
+		for range replies {
+		}
+	}()
+	return op.RequestId
+}
+
+// settle waits until no site has anything left to process or replicate
+func (sim *simulation) settle() {
+	deadline := time.Now().Add(30 * time.Second)
+	stable := 0
+	last := ""
+	for stable < 3 {
+		if time.Now().After(deadline) {
+			sim.t.Fatalf("Sites didn't settle")
+		}
+		time.Sleep(10 * time.Millisecond)
+		sim.network.Sync()
+
+		seqs := make([]string, 0)
+		for _, site := range sim.sites {
+			seqs = append(seqs, fmt.Sprint(sim.network.Store(site).Seq()))
+		}
+		current := strings.Join(seqs, ",")
+
+		if sim.network.Idle() && sim.workersIdle() && current == last {
+			stable++
+		} else {
+			stable = 0
+		}
+		last = current
+	}
+}
+
+// workersIdle returns true if no replicator has requests to handle
+func (sim *simulation) workersIdle() bool {
+	for _, r := range sim.replicators {
+		if !r.workers.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// state is what a site knows about a resource
+type state struct {
+	doc     model.ResourceDocument
+	replies []model.ReplyDocument
+}
+
+func (sim *simulation) state(site, id string) state {
+	s := sim.network.Store(site)
+	var st state
+
+	j, err := s.Get(sim.ctx, id)
+	if err != nil {
+		sim.t.Fatalf("Couldn't get %s on %s: %v", id, site, err)
+	}
+	err = json.Unmarshal(j, &st.doc)
+	if err != nil {
+		sim.t.Fatalf("Invalid document %s on %s: %v", id, site, err)
+	}
+
+	docs, err := s.Query(sim.ctx, "all-by-resourceid", id)
+	if err != nil {
+		sim.t.Fatalf("Couldn't get replies for %s on %s: %v", id, site, err)
+	}
+	for _, doc := range docs {
+		var reply model.ReplyDocument
+		err := json.Unmarshal(doc, &reply)
+		if err != nil || reply.Type != "REPLY" {
+			continue
+		}
+		st.replies = append(st.replies, reply)
+	}
+	return st
+}
+
+// destinedTo returns the replies that are sent to all the sites, formatted
+// and sorted to be compared
+func (st state) destinedTo(sites []string) []string {
+	ret := make([]string, 0)
+replies:
+	for _, reply := range st.replies {
+		for _, site := range sites {
+			found := false
+			for _, location := range reply.Locations {
+				if location == site {
+					found = true
+				}
+			}
+			if !found {
+				continue replies
+			}
+		}
+		ret = append(ret, fmt.Sprintf("%s@%s:%s", reply.RequestId, reply.Site, reply.Status))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ran returns true if the site has run the request
+func (st state) ran(site, requestId string) bool {
+	for _, reply := range st.replies {
+		if reply.Site == site && reply.RequestId == requestId && reply.Status == "OK" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConvergence verifies that every site has the same operations and the
+// same replies for the resource, among those that are sent to all of them,
+// and that every operation has been run everywhere. It returns the common
+// operations.
+func (sim *simulation) checkConvergence(id string, sites []string) []model.Operation {
+	sim.t.Helper()
+
+	reference := sim.state(sites[0], id)
+	for _, site := range sites {
+		st := sim.state(site, id)
+		if len(st.doc.Conflicts) > 0 {
+			sim.t.Fatalf("%s still has conflicts for %s: %v", site, id, st.doc.Conflicts)
+		}
+		if logops(st.doc.Operations) != logops(reference.doc.Operations) {
+			sim.t.Fatalf("Operations differ between %s and %s:\n%s\n%s", sites[0], site, logops(reference.doc.Operations), logops(st.doc.Operations))
+		}
+		expected, actual := reference.destinedTo(sites), st.destinedTo(sites)
+		if strings.Join(actual, " ") != strings.Join(expected, " ") {
+			sim.t.Fatalf("Replies differ between %s and %s:\n%v\n%v", sites[0], site, expected, actual)
+		}
+
+		for _, op := range st.doc.Operations {
+			if !st.ran(site, op.RequestId) {
+				sim.t.Fatalf("%s has not been run on %s: %v", op.RequestId, site, st.destinedTo(nil))
+			}
+		}
+	}
+
+	return reference.doc.Operations
+}
+
+// checkPurged verifies that nothing is left of the resource on the sites
+func (sim *simulation) checkPurged(id string, sites []string) {
+	sim.t.Helper()
+
+	for _, site := range sites {
+		s := sim.network.Store(site)
+		if _, err := s.Get(sim.ctx, id); err != ErrNotFound {
+			sim.t.Fatalf("%s still exists on %s: %v", id, site, err)
+		}
+		docs, err := s.Query(sim.ctx, "all-by-resourceid", id)
+		if err != nil {
+			sim.t.Fatalf("Couldn't query %s: %v", site, err)
+		}
+		if len(docs) > 0 {
+			sim.t.Fatalf("%d documents left for %s on %s", len(docs), id, site)
+		}
+	}
+}
+
+func requestIds(ops []model.Operation) []string {
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		ids = append(ids, op.RequestId)
+	}
+	return ids
+}
+
+func TestSimulationPropagation(t *testing.T) {
+	sites := []string{"s1", "s2", "s3"}
+	sim := newSimulation(t, sites...)
+
+	first := sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+	second := sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if ids := strings.Join(requestIds(ops), " "); ids != first+" "+second {
+		t.Fatalf("Expected both operations, got %s", ids)
+	}
+}
+
+func TestSimulationConcurrentCompatible(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	set := sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	sim.partition([]string{"s1"}, []string{"s2"})
+	inc := sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	dec := sim.do("s2", "res", nil, "dec", "true", model.ResourceConfig{})
+	sim.settle()
+	sim.healAll()
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if len(ops) != 3 || ops[0].RequestId != set {
+		t.Fatalf("Expected set followed by both inc and dec, got %s", logops(ops))
+	}
+	ids := requestIds(ops[1:])
+	sort.Strings(ids)
+	expected := []string{inc, dec}
+	sort.Strings(expected)
+	if strings.Join(ids, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected inc and dec after set, got %s", logops(ops))
+	}
+}
+
+func TestSimulationConcurrentIncompatible(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	sim.partition([]string{"s1"}, []string{"s2"})
+	sim.do("s1", "res", nil, "set", "true", model.ResourceConfig{})
+	set2 := sim.do("s2", "res", nil, "set", "true", model.ResourceConfig{})
+	sim.settle()
+	sim.healAll()
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if len(ops) != 1 || ops[0].RequestId != set2 {
+		t.Fatalf("Expected only the most recent set, got %s", logops(ops))
+	}
+}
+
+func TestSimulationRetry(t *testing.T) {
+	sim := newSimulation(t, "s1")
+
+	// Fails twice with exit code 1, then succeeds
+	counter := filepath.Join(t.TempDir(), "counter")
+	flaky := fmt.Sprintf("n=$(cat %[1]s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]s; [ $n -ge 3 ]", counter)
+	config := counterConfig
+	config.RetryPolicies = []model.RetryPolicy{
+		{Type: "set", MaxAttempts: 3, Backoff: model.Duration(10 * time.Millisecond), RetryableExitCodes: []int{1}},
+	}
+	set := sim.do("s1", "res", []string{"s1"}, "set", flaky, config)
+	sim.settle()
+
+	attempts := make([]string, 0)
+	for _, reply := range sim.state("s1", "res").replies {
+		if reply.RequestId == set {
+			attempts = append(attempts, fmt.Sprintf("%d:%s:%d", reply.Attempt, reply.Status, reply.ExitCode))
+		}
+	}
+	sort.Strings(attempts)
+	if strings.Join(attempts, " ") != "1:KO:1 2:KO:1 3:OK:0" {
+		t.Fatalf("Expected two failed attempts then a successful one, got %v", attempts)
+	}
+
+	// Exit codes that are not retryable fail at once
+	fail := sim.do("s1", "res", nil, "set", "exit 2", model.ResourceConfig{})
+	sim.settle()
+	statuses := make([]string, 0)
+	for _, reply := range sim.state("s1", "res").replies {
+		if reply.RequestId == fail {
+			statuses = append(statuses, fmt.Sprintf("%d:%s:%d:%s", reply.Attempt, reply.Status, reply.ExitCode, reply.ErrorClass))
+		}
+	}
+	if strings.Join(statuses, " ") != "1:KO:2:non-zero-exit" {
+		t.Fatalf("Expected a single failed attempt, got %v", statuses)
+	}
+}
+
+func TestSimulationRetrySkipped(t *testing.T) {
+	sim := newSimulation(t, "s1")
+
+	config := model.ResourceConfig{
+		RetryPolicies: []model.RetryPolicy{{Type: "apply", MaxAttempts: 3}},
+	}
+	// The failing operation and the one after it run together, once the
+	// first one is done
+	sim.do("s1", "res", []string{"s1"}, "apply", "sleep 0.5", config)
+	fail := sim.do("s1", "res", nil, "apply", "exit 1", model.ResourceConfig{})
+	skipped := sim.do("s1", "res", nil, "apply", "true", model.ResourceConfig{})
+	sim.settle()
+
+	// The skipped operation isn't run on the next change
+	last := sim.do("s1", "res", nil, "apply", "true", model.ResourceConfig{})
+	sim.settle()
+
+	replies := make(map[string][]string)
+	for _, reply := range sim.state("s1", "res").replies {
+		replies[reply.RequestId] = append(replies[reply.RequestId], fmt.Sprintf("%d:%s:%s", reply.Attempt, reply.Status, reply.ErrorClass))
+	}
+	sort.Strings(replies[fail])
+	if strings.Join(replies[fail], " ") != "1:KO:non-zero-exit 2:KO:non-zero-exit 3:KO:non-zero-exit" {
+		t.Fatalf("Expected three failed attempts, got %v", replies[fail])
+	}
+	if strings.Join(replies[skipped], " ") != "1:KO:skipped" {
+		t.Fatalf("Expected the operation after the failure to be skipped once, got %v", replies[skipped])
+	}
+	if strings.Join(replies[last], " ") != "1:OK:" {
+		t.Fatalf("Expected the last operation to run, got %v", replies[last])
+	}
+}
+
+func TestSimulationRetryReplies(t *testing.T) {
+	sim := newSimulation(t, "s1")
+	r := sim.replicators["s1"]
+
+	// As many resources as workers wait for their backoff
+	waiting := model.ResourceConfig{
+		RetryPolicies: []model.RetryPolicy{{Type: "apply", MaxAttempts: 2, Backoff: model.Duration(time.Minute)}},
+	}
+	for i := 0; i < r.workers.metrics().Workers; i++ {
+		sim.do("s1", fmt.Sprintf("waiting%d", i), []string{"s1"}, "apply", "exit 1", waiting)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for m := r.workers.metrics(); m.Delayed != m.Workers; m = r.workers.metrics() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every resource to wait for its backoff, got %#v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Another resource still runs, and the request only gets the attempt
+	// that succeeded
+	counter := filepath.Join(t.TempDir(), "counter")
+	flaky := fmt.Sprintf("n=$(cat %[1]s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]s; [ $n -ge 2 ]", counter)
+	config := model.ResourceConfig{
+		RetryPolicies: []model.RetryPolicy{{Type: "apply", MaxAttempts: 3, Backoff: model.Duration(10 * time.Millisecond)}},
+	}
+	op := model.Operation{
+		Type:      "apply",
+		RequestId: "s1-request-flaky",
+		Command:   backends.Command{Command: flaky},
+		Time:      time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(sim.ctx, 10*time.Second)
+	defer cancel()
+	replies, err := r.Do(ctx, []string{"s1"}, "res", op, config)
+	if err != nil {
+		t.Fatalf("Couldn't do %s: %v", op.RequestId, err)
+	}
+	got := make([]string, 0)
+	for reply := range replies {
+		got = append(got, fmt.Sprintf("%d:%s", reply.Attempt, reply.Status))
+	}
+	if strings.Join(got, " ") != "2:OK" {
+		t.Fatalf("Expected only the second attempt, got %v", got)
+	}
+}
+
+func TestSimulationCommandTimeout(t *testing.T) {
+	sim := newSimulation(t, "s1")
+
+	config := counterConfig
+	config.Timeout = model.Duration(100 * time.Millisecond)
+	set := sim.do("s1", "res", []string{"s1"}, "set", "sleep 5", config)
+	sim.settle()
+
+	statuses := make([]string, 0)
+	for _, reply := range sim.state("s1", "res").replies {
+		if reply.RequestId == set {
+			statuses = append(statuses, fmt.Sprintf("%s:%s", reply.Status, reply.ErrorClass))
+		}
+	}
+	if strings.Join(statuses, " ") != "TIMEOUT:timeout" {
+		t.Fatalf("Expected the command to time out, got %v", statuses)
+	}
+}
+
+func TestSimulationCancel(t *testing.T) {
+	sim := newSimulation(t, "s1")
+
+	if err := sim.replicators["s1"].Cancel("unknown"); err != ErrDoesNotExist {
+		t.Fatalf("Expected an error for a request that isn't running, got %v", err)
+	}
+
+	config := counterConfig
+	config.RetryPolicies = []model.RetryPolicy{{Type: "set", MaxAttempts: 3}}
+	set := sim.do("s1", "res", []string{"s1"}, "set", "sleep 5", config)
+	deadline := time.Now().Add(5 * time.Second)
+	for sim.replicators["s1"].Cancel(set) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("The command never ran")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sim.settle()
+
+	// Canceled commands are not retried
+	statuses := make([]string, 0)
+	for _, reply := range sim.state("s1", "res").replies {
+		if reply.RequestId == set {
+			statuses = append(statuses, fmt.Sprintf("%d:%s:%s", reply.Attempt, reply.Status, reply.ErrorClass))
+		}
+	}
+	if strings.Join(statuses, " ") != "1:KO:canceled" {
+		t.Fatalf("Expected a single canceled attempt, got %v", statuses)
+	}
+}
+
+func TestSimulationTemplates(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	greet := config.Template{
+		Name:       "greet",
+		Command:    "echo {{name}}",
+		Parameters: []config.Parameter{{Name: "name", Pattern: "[a-z]+", Required: true}},
+	}
+	sim.replicators["s1"].operations = config.Operations{Permissive: true, Templates: []config.Template{greet}}
+	sim.replicators["s2"].operations = config.Operations{Templates: []config.Template{greet}}
+
+	// s2 doesn't run raw commands, even when another site accepted them
+	raw := sim.do("s1", "res", sites, "set", "echo raw", counterConfig)
+	sim.settle()
+
+	// Each site makes the command from its own template, whatever the
+	// site that received the request made of it
+	sim.requests++
+	op := model.Operation{
+		Type:      "inc",
+		RequestId: fmt.Sprintf("s1-request-%d", sim.requests),
+		Command:   backends.Command{Command: "echo injected", Template: "greet", Params: map[string]string{"name": "bob"}},
+		Time:      time.Now(),
+	}
+	replies, err := sim.replicators["s1"].Do(sim.ctx, nil, "res", op, model.ResourceConfig{})
+	if err != nil {
+		t.Fatalf("Couldn't do %s: %v", op.RequestId, err)
+	}
+	go func() {
+		for range replies {
+		}
+	}()
+	sim.settle()
+
+	results := make([]string, 0)
+	for _, reply := range sim.state("s1", "res").replies {
+		results = append(results, fmt.Sprintf("%s@%s:%s:%s:%s", reply.RequestId, reply.Site, reply.Status, reply.ErrorClass, strings.TrimSpace(reply.Stdout)))
+	}
+	sort.Strings(results)
+	expected := []string{
+		raw + "@s1:OK::raw",
+		raw + "@s2:KO:refused:",
+		op.RequestId + "@s1:OK::bob",
+		op.RequestId + "@s2:OK::bob",
+	}
+	sort.Strings(expected)
+	if strings.Join(results, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestSimulationCleanupTemplate(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	cleanups := filepath.Join(t.TempDir(), "cleanups")
+	bye := config.Template{
+		Name:       "bye",
+		Command:    "echo bye {{name}} >> " + cleanups,
+		Parameters: []config.Parameter{{Name: "name", Pattern: "[a-z]+", Required: true}},
+	}
+	for _, site := range sites {
+		sim.replicators[site].operations = config.Operations{Templates: []config.Template{bye}}
+	}
+
+	resourceConfig := model.ResourceConfig{CleanupTemplate: "bye", CleanupParams: map[string]string{"name": "res"}}
+	sim.do("s1", "res", sites, "set", "true", resourceConfig)
+	sim.settle()
+
+	// Sites that only run templates run the cleanup of the config
+	sim.del("s1", "res", "")
+	sim.settle()
+
+	sim.checkPurged("res", sites)
+	content, _ := os.ReadFile(cleanups)
+	if strings.Count(string(content), "bye res") != len(sites) {
+		t.Fatalf("Expected the cleanup template to run on every site, got %q", content)
+	}
+}
+
+func TestSimulationIsolatedSite(t *testing.T) {
+	sites := []string{"s1", "s2", "s3"}
+	sim := newSimulation(t, sites...)
+
+	set := sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	// s3 is offline while the other sites keep working
+	sim.isolate("s3")
+	sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	sim.healAll()
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if len(ops) != 3 || ops[0].RequestId != set {
+		t.Fatalf("Expected set followed by both inc, got %s", logops(ops))
+	}
+}
+
+func TestSimulationTimeout(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+	sim.isolate("s2")
+
+	// The isolated site times out when the deadline of the request is reached
+	ctx, cancel := context.WithTimeout(sim.ctx, 200*time.Millisecond)
+	defer cancel()
+	op := model.Operation{
+		Type:      "set",
+		RequestId: "s1-request-timeout",
+		Command:   backends.Command{Command: "true"},
+		Time:      time.Now(),
+	}
+	start := time.Now()
+	replies, err := sim.replicators["s1"].Do(ctx, sites, "res", op, counterConfig)
+	if err != nil {
+		t.Fatalf("Couldn't do: %v", err)
+	}
+	statuses := make(map[string]string)
+	for reply := range replies {
+		statuses[reply.Site] = reply.Status
+	}
+	if statuses["s1"] != "OK" || statuses["s2"] != "TIMEOUT" {
+		t.Fatalf("Expected s1 OK and s2 TIMEOUT, got %v", statuses)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultTimeout/2 {
+		t.Fatalf("Replies took %v, the deadline was ignored", elapsed)
+	}
+
+	sim.healAll()
+	sim.settle()
+	sim.checkConvergence("res", sites)
+}
+
+func TestSimulationRequestStatus(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	if _, err := sim.replicators["s1"].RequestStatus(sim.ctx, "unknown"); err != ErrDoesNotExist {
+		t.Fatalf("Expected an unknown request, got %v", err)
+	}
+
+	// s2 can't reply while it is isolated
+	sim.isolate("s2")
+	set := sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+	status, err := sim.replicators["s1"].RequestStatus(sim.ctx, set)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.ResourceId != "res" || len(status.Replies) != 1 || status.Replies[0].Site != "s1" || strings.Join(status.Pending, " ") != "s2" {
+		t.Fatalf("Expected a reply from s1 and s2 pending, got %#v", status)
+	}
+
+	sim.healAll()
+	sim.settle()
+	status, _ = sim.replicators["s1"].RequestStatus(sim.ctx, set)
+	if len(status.Replies) != 2 || len(status.Pending) != 0 {
+		t.Fatalf("Expected replies from both sites, got %#v", status)
+	}
+	for _, reply := range status.Replies {
+		if reply.Identity != "tester" {
+			t.Fatalf("Expected the identity of the caller in the reply, got %q", reply.Identity)
+		}
+	}
+
+	// Only the leaving site replies to a relocation
+	relocation := sim.relocate("s1", "res", []string{"s1"}, "true")
+	sim.settle()
+	status, _ = sim.replicators["s1"].RequestStatus(sim.ctx, relocation)
+	if len(status.Replies) != 1 || status.Replies[0].Site != "s2" || len(status.Pending) != 0 {
+		t.Fatalf("Expected a reply from s2 only, got %#v", status)
+	}
+	if status.Replies[0].Identity != "tester" {
+		t.Fatalf("Expected the identity of the caller in the teardown reply, got %q", status.Replies[0].Identity)
+	}
+}
+
+func TestSimulationThreeSitesConcurrent(t *testing.T) {
+	sites := []string{"s1", "s2", "s3"}
+	sim := newSimulation(t, sites...)
+
+	sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	// Every site writes while being cut from the others
+	for _, site := range sites {
+		sim.isolate(site)
+	}
+	inc := sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	dec := sim.do("s2", "res", nil, "dec", "true", model.ResourceConfig{})
+	set := sim.do("s3", "res", nil, "set", "true", model.ResourceConfig{})
+	sim.settle()
+
+	sim.healAll()
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if len(ops) != 3 || ops[0].RequestId != set {
+		t.Fatalf("Expected the most recent set followed by inc and dec, got %s", logops(ops))
+	}
+	ids := requestIds(ops[1:])
+	sort.Strings(ids)
+	expected := []string{inc, dec}
+	sort.Strings(expected)
+	if strings.Join(ids, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected inc and dec after set, got %s", logops(ops))
+	}
+}
+
+func TestSimulationDelete(t *testing.T) {
+	sites := []string{"s1", "s2", "s3"}
+	sim := newSimulation(t, sites...)
+
+	cleanups := filepath.Join(t.TempDir(), "cleanups")
+	config := counterConfig
+	config.Cleanup = "echo cleaned >> " + cleanups
+
+	sim.do("s1", "res", sites, "set", "true", config)
+	sim.settle()
+	sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	deletion := sim.del("s3", "res", "")
+	sim.settle()
+
+	sim.checkPurged("res", sites)
+	content, _ := os.ReadFile(cleanups)
+	if strings.Count(string(content), "cleaned") != len(sites) {
+		t.Fatalf("Expected a cleanup on every site, got %q", content)
+	}
+
+	// What was purged is still known after a restart, when a late site
+	// sends the resource again
+	tombstoned, _ := json.Marshal(model.ResourceDocument{Id: "res", Type: "RESOURCE", Tombstone: &model.Operation{RequestId: deletion}})
+	for _, site := range sites {
+		purged := newPurgedDocs(sim.ctx, sim.network.Store(site))
+		if !purged.contains(tombstoned) || len(purged.replies) == 0 {
+			t.Fatalf("Expected %s to remember what it purged", site)
+		}
+	}
+
+	// The id can be used again
+	sim.do("s1", "res", sites, "set", "true", config)
+	sim.settle()
+	sim.checkConvergence("res", sites)
+}
+
+func TestSimulationDeleteFailed(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	// The cleanup is refused on s2 only, that only runs templates
+	sim.replicators["s2"].operations = config.Operations{}
+	deletion := sim.del("s1", "res", "true")
+	sim.settle()
+
+	for _, site := range sites {
+		st := sim.state(site, "res")
+		if st.doc.Tombstone == nil || st.doc.Tombstone.RequestId != deletion {
+			t.Fatalf("Expected %s to keep the tombstone, got %v", site, st.doc.Tombstone)
+		}
+		cleanups := make([]string, 0)
+		for _, reply := range st.replies {
+			if reply.RequestId == deletion {
+				cleanups = append(cleanups, fmt.Sprintf("%s:%s:%s", reply.Site, reply.Status, reply.ErrorClass))
+			}
+		}
+		sort.Strings(cleanups)
+		if strings.Join(cleanups, " ") != "s1:OK: s2:KO:refused" {
+			t.Fatalf("Expected %s to keep the replies of the cleanup, got %v", site, cleanups)
+		}
+	}
+}
+
+func TestSimulationDeleteConcurrentWrite(t *testing.T) {
+	sites := []string{"s1", "s2", "s3"}
+	sim := newSimulation(t, sites...)
+
+	sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.settle()
+
+	// s2 writes while the others delete
+	sim.isolate("s2")
+	sim.del("s1", "res", "true")
+	sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	if _, err := sim.network.Store("s1").Get(sim.ctx, "res"); err != nil {
+		t.Fatalf("Resource shouldn't be purged before s2 cleaned up: %v", err)
+	}
+
+	sim.healAll()
+	sim.settle()
+
+	sim.checkPurged("res", sites)
+}
+
+func TestSimulationRelocate(t *testing.T) {
+	sim := newSimulation(t, "s1", "s2", "s3")
+
+	teardowns := filepath.Join(t.TempDir(), "teardowns")
+	config := counterConfig
+	config.Cleanup = "echo teardown >> " + teardowns
+
+	set := sim.do("s1", "res", []string{"s1", "s2"}, "set", "true", config)
+	sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	// s2 is replaced by s3, which replays everything
+	sim.relocate("s1", "res", []string{"s1", "s3"}, "")
+	sim.settle()
+
+	sim.checkConvergence("res", []string{"s1", "s3"})
+	content, _ := os.ReadFile(teardowns)
+	if strings.Count(string(content), "teardown") != 1 {
+		t.Fatalf("Expected a single teardown, got %q", content)
+	}
+	st := sim.state("s1", "res")
+	if len(st.doc.Leaving) != 1 || st.doc.Leaving[0].Site != "s2" || !st.doc.Leaving[0].Done {
+		t.Fatalf("Expected s2 to have left, got %#v", st.doc.Leaving)
+	}
+	jobs, _ := sim.network.Store("s1").Replications(sim.ctx)
+	if _, ok := jobs["s2"]; ok {
+		t.Fatalf("Replication to s2 should have been retired")
+	}
+
+	// s2 doesn't follow anymore
+	inc := sim.do("s3", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+	sim.checkConvergence("res", []string{"s1", "s3"})
+	for _, op := range sim.state("s2", "res").doc.Operations {
+		if op.RequestId == inc {
+			t.Fatalf("s2 shouldn't receive operations anymore")
+		}
+	}
+
+	// s2 comes back and replays everything
+	sim.relocate("s3", "res", []string{"s1", "s2", "s3"}, "")
+	sim.settle()
+	sim.checkConvergence("res", []string{"s1", "s2", "s3"})
+
+	runs := 0
+	for _, reply := range sim.state("s2", "res").replies {
+		if reply.RequestId == set && reply.Site == "s2" {
+			runs++
+		}
+	}
+	if runs != 2 {
+		t.Fatalf("Expected s2 to run the set again when coming back, ran it %d times", runs)
+	}
+}
+
+func TestSimulationCompaction(t *testing.T) {
+	sites := []string{"s1", "s2"}
+	sim := newSimulation(t, sites...)
+
+	sim.do("s1", "res", sites, "set", "true", counterConfig)
+	sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+	set := sim.do("s2", "res", nil, "set", "true", model.ResourceConfig{})
+	sim.settle()
+
+	// Replies that are too recent are kept
+	sim.replicators["s1"].compact(sim.ctx, time.Now().Add(-time.Hour))
+	if n := len(sim.state("s1", "res").replies); n != 6 {
+		t.Fatalf("Expected all 6 replies to be kept, got %d", n)
+	}
+
+	for _, site := range sites {
+		sim.replicators[site].compact(sim.ctx, time.Now())
+	}
+	sim.settle()
+
+	for _, site := range sites {
+		st := sim.state(site, "res")
+		if ids := st.destinedTo(nil); len(ids) != 2 || !st.ran("s1", set) || !st.ran("s2", set) {
+			t.Fatalf("Expected only the replies of the last set on %s, got %v", site, ids)
+		}
+	}
+	m := sim.replicators["s1"].Metrics().Compaction
+	if m.Runs != 2 || m.RepliesRemoved != 4 || m.Errors != 0 {
+		t.Fatalf("Unexpected metrics: %#v", m)
+	}
+
+	// The remaining operation isn't run again
+	inc := sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+	ops := sim.checkConvergence("res", sites)
+	if ids := strings.Join(requestIds(ops), " "); ids != set+" "+inc {
+		t.Fatalf("Expected the last set and inc, got %s", ids)
+	}
+	if n := len(sim.state("s1", "res").replies); n != 4 {
+		t.Fatalf("Expected the set to run only once per site, got %v", sim.state("s1", "res").destinedTo(nil))
+	}
+}
+
+func TestSimulationSnapshot(t *testing.T) {
+	sim := newSimulation(t, "s1", "s2", "s3")
+	sites := []string{"s1", "s2"}
+	config := model.ResourceConfig{Snapshots: []model.OperationType{"snap"}}
+
+	sim.do("s1", "res", sites, "inc", "true", config)
+	sim.do("s1", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+
+	// s2 doesn't get the snapshot: nothing can be dropped
+	sim.isolate("s2")
+	snap := sim.do("s1", "res", nil, "snap", "true", model.ResourceConfig{})
+	sim.settle()
+	sim.replicators["s1"].compact(sim.ctx, time.Now())
+	if n := len(sim.state("s1", "res").doc.Operations); n != 3 {
+		t.Fatalf("Operations were dropped before every location ran the snapshot: %d left", n)
+	}
+
+	sim.healAll()
+	sim.settle()
+	inc := sim.do("s2", "res", nil, "inc", "true", model.ResourceConfig{})
+	sim.settle()
+	for _, site := range sites {
+		sim.replicators[site].compact(sim.ctx, time.Now())
+	}
+	sim.settle()
+
+	ops := sim.checkConvergence("res", sites)
+	if ids := strings.Join(requestIds(ops), " "); ids != snap+" "+inc {
+		t.Fatalf("Expected the operations to start at the snapshot, got %s", ids)
+	}
+	if m := sim.replicators["s1"].Metrics().Compaction; m.OperationsDropped != 2 {
+		t.Fatalf("Expected 2 operations dropped, got %#v", m)
+	}
+
+	// A new location replays from the snapshot
+	sim.relocate("s1", "res", []string{"s1", "s2", "s3"}, "")
+	sim.settle()
+	sim.checkConvergence("res", []string{"s1", "s2", "s3"})
+	st := sim.state("s3", "res")
+	ran := make([]string, 0)
+	for _, reply := range st.replies {
+		if reply.Site == "s3" {
+			ran = append(ran, reply.RequestId)
+		}
+	}
+	sort.Strings(ran)
+	expected := []string{snap, inc}
+	sort.Strings(expected)
+	if strings.Join(ran, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected s3 to run the snapshot and what follows, ran %v", ran)
+	}
+}
@@ -0,0 +1,109 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"cheops.com/model"
+)
+
+// RequestStatus is what this node knows of a request
+type RequestStatus struct {
+	RequestId  string
+	ResourceId string
+
+	// Every reply to the request, in the order they were executed
+	Replies []model.ReplyDocument
+
+	// Sites that are expected to reply and haven't yet
+	Pending []string
+}
+
+// RequestStatus returns the replies to the request from all the sites, and
+// the sites that haven't replied yet. The sites expected to reply are the
+// sites leaving the resource for a relocation, and the locations of the
+// resource otherwise.
+//
+// If the request isn't known on this node, because it hasn't been replicated
+// here yet or because it was compacted away, ErrDoesNotExist is returned
+func (r *Replicator) RequestStatus(ctx context.Context, requestId string) (RequestStatus, error) {
+	docs, err := r.s.Query(ctx, "by-request", requestId)
+	if err != nil {
+		return RequestStatus{}, fmt.Errorf("Couldn't get documents of request %s: %v", requestId, err)
+	}
+
+	status := RequestStatus{
+		RequestId: requestId,
+		Replies:   make([]model.ReplyDocument, 0),
+		Pending:   make([]string, 0),
+	}
+	var resource *model.ResourceDocument
+	for _, doc := range docs {
+		var typ struct {
+			Type string
+		}
+		if err := json.Unmarshal(doc, &typ); err != nil {
+			continue
+		}
+
+		switch typ.Type {
+		case "REPLY":
+			var reply model.ReplyDocument
+			if err := json.Unmarshal(doc, &reply); err != nil {
+				continue
+			}
+			status.Replies = append(status.Replies, reply)
+		case "RESOURCE":
+			if resource != nil {
+				continue
+			}
+			var d model.ResourceDocument
+			if err := json.Unmarshal(doc, &d); err != nil {
+				continue
+			}
+			resource = &d
+		}
+	}
+	if resource == nil && len(status.Replies) == 0 {
+		return RequestStatus{}, ErrDoesNotExist
+	}
+	sort.Slice(status.Replies, func(i, j int) bool {
+		return status.Replies[i].ExecutionTime.Before(status.Replies[j].ExecutionTime)
+	})
+
+	var expected []string
+	switch {
+	case resource != nil:
+		status.ResourceId = resource.Id
+		expected = resource.Locations
+		departures := make([]string, 0)
+		for _, departure := range resource.Leaving {
+			if departure.RequestId == requestId {
+				departures = append(departures, departure.Site)
+			}
+		}
+		relocation := resource.Relocation != nil && resource.Relocation.RequestId == requestId
+		if relocation || len(departures) > 0 {
+			expected = departures
+		}
+	default:
+		// The operation was dropped from the resource, its replies are all
+		// that is left
+		last := status.Replies[len(status.Replies)-1]
+		status.ResourceId = last.ResourceId
+		expected = last.Locations
+	}
+
+	replied := make(map[string]bool)
+	for _, reply := range status.Replies {
+		replied[reply.Site] = true
+	}
+	for _, site := range expected {
+		if !replied[site] {
+			status.Pending = append(status.Pending, site)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,110 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the document doesn't exist
+	ErrNotFound error = fmt.Errorf("not found")
+
+	// ErrConflict is returned by a Store when the document can't be written
+	// because the given revision isn't the current one
+	ErrConflict error = fmt.Errorf("conflict")
+)
+
+// A Store is the document database the Replicator works on. It is modelled
+// after CouchDB: documents are raw json, and the _id, _rev, _conflicts and
+// _deleted fields have the same meaning in every implementation.
+//
+// Views are identified by name. Every implementation must provide:
+//   - all-by-resourceid: key is [resource id, site], for RESOURCE and REPLY documents
+//   - last-reply: key is [site, resource id], for REPLY documents
+//   - by-location: key is [site, resource id], for RESOURCE documents, for
+//     every location and every site that is leaving
+//   - by-request: key is [request id, site] for REPLY documents, and
+//     [request id] for the RESOURCE document of every request it carries:
+//     operations, tombstone, relocation and departures
+type Store interface {
+	// Get returns the winning revision of the document, with the list of
+	// conflicting revisions in _conflicts.
+	// If the document doesn't exist, ErrNotFound is returned
+	Get(ctx context.Context, id string) (json.RawMessage, error)
+
+	// GetRev returns a specific revision of the document
+	GetRev(ctx context.Context, id, rev string) (json.RawMessage, error)
+
+	// Put creates or updates the document with the given id. An update must
+	// carry the _rev it replaces, otherwise ErrConflict is returned
+	Put(ctx context.Context, id string, doc interface{}) error
+
+	// Post creates a new document with an id chosen by the store
+	Post(ctx context.Context, doc interface{}) error
+
+	// Delete deletes the given revision of the document
+	Delete(ctx context.Context, id, rev string) error
+
+	// Purge removes all revisions of the documents, as if they never
+	// existed. Purges are local: they are not replicated.
+	Purge(ctx context.Context, ids ...string) error
+
+	// Compact reclaims the space taken by old revisions and by what was
+	// deleted or purged. It returns an estimation of the number of bytes
+	// reclaimed; the compaction itself may still be running when it returns.
+	Compact(ctx context.Context) (int64, error)
+
+	// Query returns the documents of the view whose key starts with the
+	// given parts. Empty parts are ignored.
+	Query(ctx context.Context, view string, key ...string) ([]json.RawMessage, error)
+
+	// Groups returns the distinct keys of the view, truncated to the given level
+	Groups(ctx context.Context, view string, level int) ([][]string, error)
+
+	// AllDocs returns all documents of the database
+	AllDocs(ctx context.Context) ([]json.RawMessage, error)
+
+	// Changes follows the changes feed starting after since and calls
+	// onChange for each change, in order. since is either empty for the
+	// beginning of the feed, "now", or the Seq of a previous change.
+	// It returns when the feed is interrupted or the context is done.
+	Changes(ctx context.Context, since string, onChange func(DocChange)) error
+
+	// LastSeq returns the Seq of the last change of the feed
+	LastSeq(ctx context.Context) (string, error)
+
+	// Checkpoint returns the Seq of the last change processed by the named
+	// follower of the changes feed, or an empty string if it hasn't saved
+	// any. Checkpoints are local: they are not replicated.
+	Checkpoint(ctx context.Context, name string) (string, error)
+
+	// SetCheckpoint saves the Seq of the last change processed by the named
+	// follower. An empty seq removes the checkpoint.
+	SetCheckpoint(ctx context.Context, name, seq string) error
+
+	// LocalDoc returns the named local document, or ErrNotFound if there
+	// is none. Local documents are not replicated.
+	LocalDoc(ctx context.Context, name string) (json.RawMessage, error)
+
+	// SetLocalDoc creates or replaces the named local document
+	SetLocalDoc(ctx context.Context, name string, doc interface{}) error
+
+	// Replications returns the locations a replication job exists for
+	Replications(ctx context.Context) (map[string]struct{}, error)
+
+	// Replicate creates a continuous replication job that sends all
+	// documents destined to location there: those that have location in
+	// their Locations, or in their Leaving sites that are not done
+	Replicate(ctx context.Context, location string) error
+
+	// Unreplicate removes the replication job to location
+	Unreplicate(ctx context.Context, location string) error
+}
+
+// DocChange is a single entry of the changes feed
+type DocChange struct {
+	Seq string          `json:"seq"`
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
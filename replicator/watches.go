@@ -1,100 +1,357 @@
 package replicator
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
-	"net/http"
-	"strings"
+	"sync"
 	"time"
 )
 
 type onNewDocFunc func(j json.RawMessage)
 
+// checkpointInterval is how often the position of durable watchers is saved
+const checkpointInterval = 1 * time.Second
+
 // watch watches the _changes feed of the cheops database, resolves all conflicts for said document
 // and runs a function when a new document is seen.
 // The document is sent as a raw json string, to be decoded by the function.
-// The execution of the function blocks the loop; it is good to not have it run too long
+//
+// Watchers added with watch only see the changes that happen after they are
+// added. Each of them has its own queue, so that a slow watcher
+// doesn't delay the others until its queue is full. Durable watchers follow
+// their own feed and save their position in the store, so that they resume
+// where they stopped after a restart instead of seeing the whole database
+// again. A durable watcher blocks its own feed until it returns, but it can
+// hand the change over and tell later when it is done: the checkpoint only
+// goes past changes that are done.
 type watches struct {
-	watchers []onNewDocFunc
+	ctx context.Context
+	s   Store
+
+	sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// name -> durable watcher
+	durable map[string]*durableWatcher
+}
+
+// watchQueueSize is how many changes can wait for a watcher before the feed
+// waits for it
+const watchQueueSize = 64
+
+// watcher is a function that follows the shared feed through its queue
+type watcher struct {
+	f     onNewDocFunc
+	queue chan json.RawMessage
+
+	// closed when the watcher is removed
+	done chan struct{}
+}
+
+// onChangeFunc handles a change for a durable watcher. done must be called
+// once the change is processed, possibly after the function returned
+type onChangeFunc func(j json.RawMessage, done func())
+
+// durableWatcher is a watcher that follows its own feed from its checkpoint
+type durableWatcher struct {
+	name string
+	f    onChangeFunc
+
+	// A reset is sent here; the error of the reset is sent back
+	reset chan chan error
+
+	checkpoint
+}
+
+// checkpoint is the position of a durable watcher in the changes feed: the
+// last change that was processed, along with all the changes before it
+type checkpoint struct {
+	sync.Mutex
+
+	seq string
+
+	// true if seq hasn't been saved yet
+	dirty bool
+
+	// changes being processed, in the order of the feed
+	inflight []*inflightChange
+}
+
+type inflightChange struct {
+	seq  string
+	done bool
+}
+
+// start records that the change is being processed, and returns the
+// function to call when it is done
+func (c *checkpoint) start(seq string) func() {
+	c.Lock()
+	defer c.Unlock()
+
+	change := &inflightChange{seq: seq}
+	c.inflight = append(c.inflight, change)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.Lock()
+			defer c.Unlock()
+
+			change.done = true
+			for len(c.inflight) > 0 && c.inflight[0].done {
+				c.seq = c.inflight[0].seq
+				c.dirty = true
+				c.inflight = c.inflight[1:]
+			}
+		})
+	}
 }
 
-func newWatches(ctx context.Context) *watches {
+func newWatches(ctx context.Context, s Store) *watches {
 	w := &watches{
-		watchers: make([]onNewDocFunc, 0),
+		ctx:      ctx,
+		s:        s,
+		watchers: make(map[*watcher]struct{}),
+		durable:  make(map[string]*durableWatcher),
 	}
 	w.startWatching(ctx)
 
 	return w
 }
 
-func (w *watches) watch(f onNewDocFunc) {
-	w.watchers = append(w.watchers, f)
+// watch runs f on every new change, until the returned function is called
+func (w *watches) watch(f onNewDocFunc) (cancel func()) {
+	wt := &watcher{
+		f:     f,
+		queue: make(chan json.RawMessage, watchQueueSize),
+		done:  make(chan struct{}),
+	}
+	w.Lock()
+	w.watchers[wt] = struct{}{}
+	w.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-wt.done:
+				return
+			case j := <-wt.queue:
+				wt.f(j)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.Lock()
+			delete(w.watchers, wt)
+			w.Unlock()
+			close(wt.done)
+		})
+	}
+}
+
+// dispatch sends the document to the queue of every watcher
+func (w *watches) dispatch(j json.RawMessage) {
+	w.Lock()
+	watchers := make([]*watcher, 0, len(w.watchers))
+	for wt := range w.watchers {
+		watchers = append(watchers, wt)
+	}
+	w.Unlock()
+
+	for _, wt := range watchers {
+		select {
+		case wt.queue <- j:
+		case <-wt.done:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// watchDurable runs f on every change, starting after the last change it
+// processed in a previous run, as saved under the given name. Changes may be
+// seen again after a restart, f must be idempotent.
+func (w *watches) watchDurable(name string, f onChangeFunc) {
+	d := &durableWatcher{
+		name:  name,
+		f:     f,
+		reset: make(chan chan error),
+	}
+	w.Lock()
+	w.durable[name] = d
+	w.Unlock()
+	go w.follow(d)
+	go w.saveCheckpoints(d)
 }
 
 func (w *watches) startWatching(ctx context.Context) {
 	retryTime := 1
 
+	// Only the changes from now on
+	since, err := w.s.LastSeq(ctx)
+	if err != nil {
+		log.Printf("Couldn't get the last sequence: %v\n", err)
+		since = "now"
+	}
+
 	go func() {
-		since := ""
 		for {
-			u := "http://localhost:5984/cheops/_changes?include_docs=true&feed=continuous"
-			if since != "" {
-				u += fmt.Sprintf("&since=%s", since)
+			gotChanges := false
+			err := w.s.Changes(ctx, since, func(change DocChange) {
+				if retryTime > 1 && !gotChanges {
+					log.Println("Got _changes feed back, let's go")
+					retryTime = 1
+				}
+				gotChanges = true
+
+				w.dispatch(change.Doc)
+				since = change.Seq
+			})
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
 			}
-			req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+
 			if err != nil {
-				log.Printf("Couldn't create request with context: %v\n", err)
-				break
-			}
-			feed, err := http.DefaultClient.Do(req)
-			if err != nil || feed.StatusCode != 200 {
 				// When the database is deleted, we are here. Hopefully it will be recreated and we can continue
-				log.Printf("No _changes feed, retrying in %ds", retryTime)
+				log.Printf("No _changes feed (%v), retrying in %ds", err, retryTime)
 				<-time.After(time.Duration(retryTime) * time.Second)
 				retryTime = 2 * retryTime
-				continue
 			}
+		}
+	}()
+}
+
+// follow runs the feed of a durable watcher, from its checkpoint
+func (w *watches) follow(d *durableWatcher) {
+	retryTime := 1
 
-			if retryTime > 1 {
-				log.Println("Got _changes feed back, let's go")
+	since, err := w.s.Checkpoint(w.ctx, d.name)
+	if err != nil {
+		// Seeing everything again is slow but safe
+		log.Printf("Couldn't get the checkpoint of %s, starting from the beginning: %v\n", d.name, err)
+	}
+	d.Lock()
+	d.seq = since
+	d.Unlock()
+
+	for {
+		ctx, cancel := context.WithCancel(w.ctx)
+		resets := make(chan chan error, 1)
+		go func() {
+			var reset chan error
+			select {
+			case <-ctx.Done():
+			case reset = <-d.reset:
+				cancel()
+			}
+			resets <- reset
+		}()
+
+		gotChanges := false
+		err := w.s.Changes(ctx, since, func(change DocChange) {
+			if retryTime > 1 && !gotChanges {
+				log.Printf("Got _changes feed back for %s, let's go\n", d.name)
 				retryTime = 1
 			}
+			gotChanges = true
 
-			defer feed.Body.Close()
+			d.f(change.Doc, d.start(change.Seq))
+			since = change.Seq
+		})
+		cancel()
+		reset := <-resets
 
-			scanner := bufio.NewScanner(feed.Body)
-			for scanner.Scan() {
-				s := strings.TrimSpace(scanner.Text())
-				if s == "" {
-					continue
-				}
+		select {
+		case <-w.ctx.Done():
+			if reset != nil {
+				reset <- w.ctx.Err()
+			}
+			return
+		default:
+		}
 
-				var change DocChange
-				err := json.NewDecoder(strings.NewReader(s)).Decode(&change)
-				if err != nil {
-					log.Printf("Couldn't decode: %s", err)
-					continue
-				}
-				if len(change.Doc) == 0 {
-					continue
-				}
+		if reset != nil {
+			since = ""
+			d.Lock()
+			d.seq = ""
+			d.dirty = false
+			d.inflight = nil
+			err := w.s.SetCheckpoint(w.ctx, d.name, "")
+			d.Unlock()
+			log.Printf("Checkpoint of %s reset\n", d.name)
+			reset <- err
+			continue
+		}
 
-				for _, f := range w.watchers {
-					f(change.Doc)
-				}
-				since = change.Seq
-			}
+		if err != nil {
+			log.Printf("No _changes feed for %s (%v), retrying in %ds", d.name, err, retryTime)
+			<-time.After(time.Duration(retryTime) * time.Second)
+			retryTime = 2 * retryTime
+		}
+	}
+}
 
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
-			}
+// saveCheckpoints regularly saves the position of the durable watcher
+func (w *watches) saveCheckpoints(d *durableWatcher) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
+		d.Lock()
+		if d.dirty && w.ctx.Err() == nil {
+			err := w.s.SetCheckpoint(w.ctx, d.name, d.seq)
+			if err != nil {
+				log.Printf("Couldn't save the checkpoint of %s: %v\n", d.name, err)
+			} else {
+				d.dirty = false
+			}
 		}
-	}()
+		d.Unlock()
+	}
+}
+
+// checkpoints returns the position of every durable watcher
+func (w *watches) checkpoints() map[string]string {
+	w.Lock()
+	defer w.Unlock()
+
+	ret := make(map[string]string)
+	for name, d := range w.durable {
+		d.Lock()
+		ret[name] = d.seq
+		d.Unlock()
+	}
+	return ret
+}
+
+// resetCheckpoint makes the named durable watcher see all the database again
+func (w *watches) resetCheckpoint(ctx context.Context, name string) error {
+	w.Lock()
+	d, ok := w.durable[name]
+	w.Unlock()
+	if !ok {
+		return ErrDoesNotExist
+	}
+
+	done := make(chan error, 1)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case d.reset <- done:
+	}
+	return <-done
 }
@@ -0,0 +1,182 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a watcher that remembers the ids of the documents it saw
+type recorder struct {
+	sync.Mutex
+	ids []string
+}
+
+func (r *recorder) watchDurable(j json.RawMessage, done func()) {
+	r.watch(j)
+	done()
+}
+
+func (r *recorder) watch(j json.RawMessage) {
+	var d struct {
+		Id string `json:"_id"`
+	}
+	json.Unmarshal(j, &d)
+	r.Lock()
+	r.ids = append(r.ids, d.Id)
+	r.Unlock()
+}
+
+// wait waits until the recorder has seen exactly the expected ids
+func (r *recorder) wait(t *testing.T, expected ...string) {
+	t.Helper()
+	sort.Strings(expected)
+
+	var seen []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		seen = append([]string{}, r.ids...)
+		r.Unlock()
+		sort.Strings(seen)
+		if strings.Join(seen, " ") == strings.Join(expected, " ") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected to see %v, saw %v", expected, seen)
+}
+
+// waitCheckpoint waits until the checkpoint of the watcher is saved at the
+// last change of the store
+func waitCheckpoint(t *testing.T, s *MemoryStore, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * checkpointInterval)
+	for time.Now().Before(deadline) {
+		seq, _ := s.Checkpoint(context.Background(), name)
+		last, _ := s.LastSeq(context.Background())
+		if seq == last {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Checkpoint of %s wasn't saved", name)
+}
+
+func TestWatchesCheckpoint(t *testing.T) {
+	s := NewMemoryNetwork().Store("s1")
+	bg := context.Background()
+	s.Put(bg, "a", map[string]string{"Type": "RESOURCE"})
+	s.Put(bg, "b", map[string]string{"Type": "RESOURCE"})
+
+	ctx, cancel := context.WithCancel(bg)
+	first := &recorder{}
+	newWatches(ctx, s).watchDurable("test", first.watchDurable)
+	first.wait(t, "a", "b")
+	waitCheckpoint(t, s, "test")
+	cancel()
+
+	// Restarting only shows what changed since
+	s.Put(bg, "c", map[string]string{"Type": "RESOURCE"})
+	ctx, cancel = context.WithCancel(bg)
+	defer cancel()
+	second := &recorder{}
+	w := newWatches(ctx, s)
+	w.watchDurable("test", second.watchDurable)
+	second.wait(t, "c")
+
+	// Until the checkpoint is reset
+	err := w.resetCheckpoint(ctx, "test")
+	if err != nil {
+		t.Fatalf("Couldn't reset: %v", err)
+	}
+	second.wait(t, "a", "b", "c", "c")
+
+	if err := w.resetCheckpoint(ctx, "unknown"); err != ErrDoesNotExist {
+		t.Fatalf("Expected an error for an unknown watcher, got %v", err)
+	}
+}
+
+func TestWatchesOnlyNewChanges(t *testing.T) {
+	s := NewMemoryNetwork().Store("s1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Put(ctx, "a", map[string]string{"Type": "RESOURCE"})
+
+	r := &recorder{}
+	newWatches(ctx, s).watch(r.watch)
+	s.Put(ctx, "b", map[string]string{"Type": "RESOURCE"})
+	r.wait(t, "b")
+}
+
+func TestWatchesCancel(t *testing.T) {
+	s := NewMemoryNetwork().Store("s1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newWatches(ctx, s)
+	r := &recorder{}
+	stop := w.watch(r.watch)
+	s.Put(ctx, "a", map[string]string{"Type": "RESOURCE"})
+	r.wait(t, "a")
+
+	stop()
+	stop()
+	s.Put(ctx, "b", map[string]string{"Type": "RESOURCE"})
+	time.Sleep(50 * time.Millisecond)
+	r.wait(t, "a")
+
+	w.Lock()
+	defer w.Unlock()
+	if len(w.watchers) != 0 {
+		t.Fatalf("Expected no watcher left, got %d", len(w.watchers))
+	}
+}
+
+func TestWatchesSlowWatcher(t *testing.T) {
+	s := NewMemoryNetwork().Store("s1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newWatches(ctx, s)
+	blocked := make(chan struct{})
+	defer close(blocked)
+	w.watch(func(j json.RawMessage) {
+		<-blocked
+	})
+	r := &recorder{}
+	w.watch(r.watch)
+
+	s.Put(ctx, "a", map[string]string{"Type": "RESOURCE"})
+	s.Put(ctx, "b", map[string]string{"Type": "RESOURCE"})
+	s.Put(ctx, "c", map[string]string{"Type": "RESOURCE"})
+	r.wait(t, "a", "b", "c")
+}
+
+func TestWatchesCheckpointWaitsForDone(t *testing.T) {
+	s := NewMemoryNetwork().Store("s1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Put(ctx, "a", map[string]string{"Type": "RESOURCE"})
+	s.Put(ctx, "b", map[string]string{"Type": "RESOURCE"})
+
+	// a is still being processed when b is done
+	dones := make(chan func(), 2)
+	newWatches(ctx, s).watchDurable("test", func(j json.RawMessage, done func()) {
+		dones <- done
+	})
+	doneA, doneB := <-dones, <-dones
+	doneB()
+	time.Sleep(2 * checkpointInterval)
+	if seq, _ := s.Checkpoint(ctx, "test"); seq != "" {
+		t.Fatalf("Checkpoint went past a change being processed: %s", seq)
+	}
+
+	doneA()
+	waitCheckpoint(t, s, "test")
+}